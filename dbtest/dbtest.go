@@ -0,0 +1,131 @@
+// Package dbtest provides Postgres databases for tests. Tests using it are
+// skipped unless TEST_DATABASE_URL points at a database they may create
+// schemas in.
+package dbtest
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/diyorend/dashGPT-backend/models"
+
+	_ "github.com/lib/pq"
+)
+
+// Open returns a database with all migrations applied, isolated from other
+// tests in a schema of its own that is dropped when the test ends
+func Open(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db := OpenSchema(t)
+	if err := models.RunMigrations(db, 0); err != nil {
+		t.Fatalf("running migrations: %v", err)
+	}
+	return db
+}
+
+// OpenSchema returns a database connected to a new empty schema, dropped when
+// the test ends. Every connection in the pool uses the schema.
+func OpenSchema(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := "test_" + randomSuffix(t)
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("dropping schema: %v", err)
+		}
+	})
+
+	db, err := sql.Open("postgres", withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatalf("opening test schema: %v", err)
+	}
+	// Registered after the schema cleanup, so it runs first
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Ping(); err != nil {
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	return db
+}
+
+// withSearchPath sets the search_path connection parameter, which lib/pq
+// passes through to the server, in either DSN form. public stays on the path
+// so extensions installed there remain visible.
+func withSearchPath(dsn, schema string) string {
+	searchPath := schema + ",public"
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			q := u.Query()
+			q.Set("search_path", searchPath)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " search_path=" + searchPath
+}
+
+func randomSuffix(t *testing.T) string {
+	t.Helper()
+
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("generating schema name: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// CreateUser inserts a user and returns its ID
+func CreateUser(t *testing.T, db *sql.DB, email string) string {
+	t.Helper()
+
+	var id string
+	err := db.QueryRow(
+		`INSERT INTO users (email, name, password) VALUES ($1, $2, $3) RETURNING id`,
+		email, "Test User", "unused",
+	).Scan(&id)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	return id
+}
+
+// CreateConversation inserts a conversation with one user message and one
+// assistant reply, returning the conversation ID
+func CreateConversation(t *testing.T, db *sql.DB, userID string) string {
+	t.Helper()
+
+	var id string
+	if err := db.QueryRow(`INSERT INTO conversations (user_id) VALUES ($1) RETURNING id`, userID).Scan(&id); err != nil {
+		t.Fatalf("creating conversation: %v", err)
+	}
+	_, err := db.Exec(
+		`INSERT INTO messages (conversation_id, role, content, created_at)
+		 VALUES ($1, 'user', 'Hello', NOW() - INTERVAL '1 second'), ($1, 'assistant', 'Hi there', NOW())`,
+		id,
+	)
+	if err != nil {
+		t.Fatalf("creating messages: %v", err)
+	}
+	return id
+}
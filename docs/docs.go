@@ -0,0 +1,66 @@
+// Package docs serves the hand-maintained OpenAPI document describing the API
+// and a Swagger UI page for browsing it
+package docs
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// ServeSpec serves the OpenAPI document
+func ServeSpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
+
+const swaggerUI = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>DashGPT API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/api/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// ServeUI serves a Swagger UI page that loads the OpenAPI document
+func ServeUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUI))
+}
+
+// UndocumentedRoutes returns the router's routes, as "METHOD /path", that are
+// missing from the OpenAPI document, so the two can be kept in sync
+func UndocumentedRoutes(routes chi.Routes) ([]string, error) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	err := chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if _, ok := doc.Paths[route][strings.ToLower(method)]; !ok {
+			missing = append(missing, method+" "+route)
+		}
+		return nil
+	})
+	sort.Strings(missing)
+	return missing, err
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/diyorend/dashGPT-backend/middleware"
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxNameLength matches the users.name column
+const maxNameLength = 255
+
+type UpdateProfileRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// UpdateProfile changes the authenticated user's name and, if given, email
+func (h *AuthHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req UpdateProfileRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Name is required")
+		return
+	}
+	if len(req.Name) > maxNameLength {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Name must be at most 255 characters")
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+	if req.Email != "" && !validEmail(req.Email) {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Email address is invalid")
+		return
+	}
+
+	// An empty email leaves the current one in place
+	var user models.User
+	err := h.db.QueryRow(
+		`UPDATE users SET name = $1, email = COALESCE(NULLIF($2, ''), email), updated_at = CURRENT_TIMESTAMP
+		 WHERE id = $3
+		 RETURNING id, email, name, role, created_at, updated_at`,
+		req.Name, req.Email, userID,
+	).Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.CreatedAt, &user.UpdatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		writeJSONError(w, http.StatusConflict, codeConflict, "Email already registered")
+		return
+	}
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error updating profile", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// DeleteAccount permanently deletes the authenticated user after re-verifying
+// their password. Conversations, messages and refresh tokens are removed by
+// the users foreign key cascades.
+func (h *AuthHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req DeleteAccountRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.Password == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Password is required")
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var passwordHash string
+	err = tx.QueryRow(`SELECT password FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&passwordHash)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidCredentials, "Password is incorrect")
+		return
+	}
+
+	// Revoke the access token used for this request. The user's other access
+	// tokens are rejected once the user no longer exists.
+	if jti, _ := r.Context().Value(middleware.TokenIDKey).(string); jti != "" {
+		_, err = tx.Exec(
+			`INSERT INTO revoked_tokens (jti, expires_at)
+			 VALUES ($1, CURRENT_TIMESTAMP + $2 * INTERVAL '1 second')
+			 ON CONFLICT (jti) DO NOTHING`,
+			jti, int(h.accessTokenTTL.Seconds()),
+		)
+		if err != nil {
+			writeInternalError(w, "Error deleting account", err)
+			return
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = $1`, userID); err != nil {
+		writeInternalError(w, "Error deleting account", err)
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = $1`, userID); err != nil {
+		writeInternalError(w, "Error deleting account", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, "Error deleting account", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/config"
+	"github.com/diyorend/dashGPT-backend/dbtest"
+	"github.com/diyorend/dashGPT-backend/mailer"
+	"github.com/diyorend/dashGPT-backend/middleware"
+	"github.com/diyorend/dashGPT-backend/tokens"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "correct horse 1"
+
+// newTestAuthHandler returns an auth handler using the cheapest bcrypt cost
+func newTestAuthHandler(db *sql.DB) *AuthHandler {
+	keys := tokens.NewHMACKeySet("test-secret")
+	return NewAuthHandler(db, keys, mailer.LogMailer{}, config.Auth{
+		BcryptCost:      bcrypt.MinCost,
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 24 * time.Hour,
+		PasswordPolicy:  config.PasswordPolicy{MinLength: 8},
+	})
+}
+
+// authRouter mounts the auth routes the tests exercise, with protected routes
+// behind AuthMiddleware as in production
+func authRouter(h *AuthHandler) http.Handler {
+	r := chi.NewRouter()
+	r.Route("/api/auth", func(r chi.Router) {
+		r.Post("/register", h.Register)
+		r.Post("/login", h.Login)
+		r.Post("/refresh", h.Refresh)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.AuthMiddleware(h.keys, h))
+			r.Get("/me", h.Me)
+			r.Delete("/account", h.DeleteAccount)
+		})
+	})
+	return r
+}
+
+// serveWithToken sends a request to handler with token as its bearer token
+func serveWithToken(handler http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// createUserWithPassword inserts a user who can log in with testPassword
+func createUserWithPassword(t *testing.T, db *sql.DB, email string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+	var id string
+	err = db.QueryRow(
+		`INSERT INTO users (email, name, password) VALUES ($1, $2, $3) RETURNING id`,
+		email, "Test User", string(hash),
+	).Scan(&id)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	return id
+}
+
+func TestDeleteAccountRevokesAllTokens(t *testing.T) {
+	db := dbtest.Open(t)
+	h := newTestAuthHandler(db)
+	router := authRouter(h)
+	userID := createUserWithPassword(t, db, "leaving@example.com")
+
+	// Two sessions, e.g. on different devices
+	token, _, err := h.issueTokens(userID, "user")
+	if err != nil {
+		t.Fatalf("issuing tokens: %v", err)
+	}
+	otherToken, otherRefreshToken, err := h.issueTokens(userID, "user")
+	if err != nil {
+		t.Fatalf("issuing tokens: %v", err)
+	}
+
+	if w := serveWithToken(router, otherToken, http.MethodGet, "/api/auth/me", ""); w.Code != http.StatusOK {
+		t.Fatalf("before deletion: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w := serveWithToken(router, token, http.MethodDelete, "/api/auth/account", `{"password":"`+testPassword+`"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete account: status = %d, want %d; body: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+
+	for name, tok := range map[string]string{"deleting session": token, "other session": otherToken} {
+		if w := serveWithToken(router, tok, http.MethodGet, "/api/auth/me", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s after deletion: status = %d, want %d", name, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	body, _ := json.Marshal(RefreshRequest{RefreshToken: otherRefreshToken})
+	if w := serveWithToken(router, "", http.MethodPost, "/api/auth/refresh", string(body)); w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after deletion: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	var refreshTokens int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM refresh_tokens WHERE user_id = $1`, userID).Scan(&refreshTokens); err != nil {
+		t.Fatalf("counting refresh tokens: %v", err)
+	}
+	if refreshTokens != 0 {
+		t.Errorf("%d refresh tokens remain", refreshTokens)
+	}
+}
+
+func TestIsTokenRevoked(t *testing.T) {
+	db := dbtest.Open(t)
+	h := newTestAuthHandler(db)
+	userID := createUserWithPassword(t, db, "revoked@example.com")
+
+	cutoff := time.Now().Truncate(time.Second)
+	if _, err := db.Exec(`UPDATE users SET tokens_valid_after = to_timestamp($1) WHERE id = $2`, cutoff.Unix(), userID); err != nil {
+		t.Fatalf("setting cutoff: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO revoked_tokens (jti, expires_at) VALUES ('logged-out', CURRENT_TIMESTAMP + INTERVAL '1 hour')`); err != nil {
+		t.Fatalf("revoking token: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		userID   string
+		jti      string
+		issuedAt time.Time
+		want     bool
+	}{
+		{"issued after the cutoff", userID, "current", cutoff.Add(time.Minute), false},
+		{"issued in the cutoff's second", userID, "current", cutoff, false},
+		{"issued before the cutoff", userID, "current", cutoff.Add(-time.Second), true},
+		{"without an ID, issued before the cutoff", userID, "", cutoff.Add(-time.Minute), true},
+		{"logged out", userID, "logged-out", cutoff.Add(time.Minute), true},
+		{"user deleted", "00000000-0000-0000-0000-000000000000", "current", cutoff.Add(time.Minute), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked, err := h.IsTokenRevoked(tt.userID, tt.jti, tt.issuedAt)
+			if err != nil {
+				t.Fatalf("checking token: %v", err)
+			}
+			if revoked != tt.want {
+				t.Errorf("revoked = %t, want %t", revoked, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type AdminHandler struct {
+	db *sql.DB
+}
+
+func NewAdminHandler(db *sql.DB) *AdminHandler {
+	return &AdminHandler{db: db}
+}
+
+// AdminStats are aggregate figures across all users
+type AdminStats struct {
+	TotalUsers         int   `json:"totalUsers"`
+	TotalConversations int   `json:"totalConversations"`
+	TotalMessages      int   `json:"totalMessages"`
+	MonthlyTokens      int64 `json:"monthlyTokens"`
+}
+
+func (h *AdminHandler) GetStats(w http.ResponseWriter, r *http.Request) {
+	var stats AdminStats
+	err := h.db.QueryRow(
+		`SELECT
+			(SELECT COUNT(*) FROM users),
+			(SELECT COUNT(*) FROM conversations),
+			(SELECT COUNT(*) FROM messages WHERE deleted_at IS NULL),
+			(SELECT COALESCE(SUM(input_tokens + output_tokens), 0) FROM user_usage
+			 WHERE month = date_trunc('month', CURRENT_DATE)::date)`,
+	).Scan(&stats.TotalUsers, &stats.TotalConversations, &stats.TotalMessages, &stats.MonthlyTokens)
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// GetConversationMessages returns a conversation's full history, including
+// messages soft-deleted by edits and regenerations, for auditing and debugging
+func (h *AdminHandler) GetConversationMessages(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var exists bool
+	err := h.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM conversations WHERE id::text = $1)`,
+		conversationID,
+	).Scan(&exists)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation", err)
+		return
+	}
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+
+	rows, err := h.db.Query(
+		`SELECT id, role, content, COALESCE(model, ''), COALESCE(stop_reason, ''), is_pinned, created_at, deleted_at
+		 FROM messages WHERE conversation_id = $1 ORDER BY created_at ASC`,
+		conversationID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error fetching messages", err)
+		return
+	}
+	defer rows.Close()
+
+	messages := []models.Message{}
+	for rows.Next() {
+		msg := models.Message{ConversationID: conversationID}
+		var deletedAt sql.NullTime
+		err := rows.Scan(&msg.ID, &msg.Role, &msg.Content, &msg.Model, &msg.StopReason, &msg.IsPinned, &msg.CreatedAt, &deletedAt)
+		if err != nil {
+			writeInternalError(w, "Error fetching messages", err)
+			return
+		}
+		if deletedAt.Valid {
+			msg.DeletedAt = &deletedAt.Time
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, "Error fetching messages", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": messages,
+	})
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// maxImagesPerMessage and maxImageSize follow the Claude API's limits
+	maxImagesPerMessage = 4
+	maxImageSize        = 5 << 20 // 5MB
+
+	// approxImageTokens is a rough cost of an image in the context window
+	approxImageTokens = 1600
+)
+
+// allowedImageTypes are the image formats Claude accepts
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// validateImages returns an error message for invalid images, or "" if they
+// are valid. The declared media type must match the data's actual format.
+func validateImages(images []Image) string {
+	if len(images) > maxImagesPerMessage {
+		return fmt.Sprintf("At most %d images may be attached to a message", maxImagesPerMessage)
+	}
+	for i, image := range images {
+		if !allowedImageTypes[image.MediaType] {
+			return fmt.Sprintf("Image %d must be a JPEG, PNG, GIF or WebP image", i+1)
+		}
+		if len(image.Data) == 0 {
+			return fmt.Sprintf("Image %d is empty", i+1)
+		}
+		if len(image.Data) > maxImageSize {
+			return fmt.Sprintf("Image %d must be at most 5MB", i+1)
+		}
+		if http.DetectContentType(image.Data) != image.MediaType {
+			return fmt.Sprintf("Image %d does not match its media type", i+1)
+		}
+	}
+	return ""
+}
+
+// loadAttachments adds the attachments of a conversation's messages, including
+// their data, to messages
+func (h *ChatHandler) loadAttachments(conversationID string, messages []models.Message) error {
+	rows, err := h.db.Query(
+		`SELECT a.id, a.message_id, a.media_type, a.size, a.data
+		 FROM message_attachments a
+		 JOIN messages m ON m.id = a.message_id
+		 WHERE m.conversation_id = $1 AND m.deleted_at IS NULL
+		 ORDER BY a.created_at ASC`,
+		conversationID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	attachments := make(map[string][]models.Attachment)
+	for rows.Next() {
+		var a models.Attachment
+		var messageID string
+		if err := rows.Scan(&a.ID, &messageID, &a.MediaType, &a.Size, &a.Data); err != nil {
+			return err
+		}
+		attachments[messageID] = append(attachments[messageID], a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].ID]
+	}
+	return nil
+}
+
+// GetAttachment serves the raw image of an attachment on a message in one of
+// the user's conversations
+func (h *ChatHandler) GetAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	attachmentID := chi.URLParam(r, "id")
+
+	var mediaType string
+	var data []byte
+	err := h.db.QueryRow(
+		`SELECT a.media_type, a.data FROM message_attachments a
+		 JOIN messages m ON m.id = a.message_id
+		 JOIN conversations c ON c.id = m.conversation_id
+		 WHERE a.id = $1 AND c.user_id = $2 AND m.deleted_at IS NULL`,
+		attachmentID, userID,
+	).Scan(&mediaType, &data)
+
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Attachment not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error fetching attachment", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(data)
+}
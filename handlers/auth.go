@@ -1,27 +1,58 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"log/slog"
 	"net/http"
+	"net/mail"
+	"strings"
 	"time"
 
+	"github.com/diyorend/dashGPT-backend/config"
+	"github.com/diyorend/dashGPT-backend/mailer"
 	"github.com/diyorend/dashGPT-backend/middleware"
 	"github.com/diyorend/dashGPT-backend/models"
+	"github.com/diyorend/dashGPT-backend/tokens"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	db        *sql.DB
-	jwtSecret string
+	db               *sql.DB
+	keys             *tokens.KeySet
+	bcryptCost       int
+	mailer           mailer.Mailer
+	passwordResetURL string
+	passwordPolicy   PasswordPolicy
+	accessTokenTTL   time.Duration
+	refreshTokenTTL  time.Duration
 }
 
-func NewAuthHandler(db *sql.DB, jwtSecret string) *AuthHandler {
+// NewAuthHandler creates an auth handler. Passwords are hashed with the
+// configured bcrypt cost, or when cfg sets a bcrypt target duration, a cost
+// calibrated to this machine's speed.
+func NewAuthHandler(db *sql.DB, keys *tokens.KeySet, m mailer.Mailer, cfg config.Auth) *AuthHandler {
+	bcryptCost := cfg.BcryptCost
+	if cfg.BcryptTargetDuration > 0 {
+		bcryptCost = CalibrateBcryptCost(cfg.BcryptTargetDuration)
+		slog.Info("Calibrated bcrypt cost", "cost", bcryptCost, "target", cfg.BcryptTargetDuration.String())
+	}
+
 	return &AuthHandler{
-		db:        db,
-		jwtSecret: jwtSecret,
+		db:               db,
+		keys:             keys,
+		bcryptCost:       bcryptCost,
+		mailer:           m,
+		passwordResetURL: cfg.PasswordResetURL,
+		passwordPolicy:   cfg.PasswordPolicy,
+		accessTokenTTL:   cfg.AccessTokenTTL,
+		refreshTokenTTL:  cfg.RefreshTokenTTL,
 	}
 }
 
@@ -36,45 +67,60 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
 type AuthResponse struct {
-	Token string      `json:"token"`
-	User  models.User `json:"user"`
+	Token        string      `json:"token"`
+	RefreshToken string      `json:"refreshToken"`
+	User         models.User `json:"user"`
+}
+
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &req) {
 		return
 	}
 
 	// Validate input
+	req.Email = normalizeEmail(req.Email)
 	if req.Email == "" || req.Password == "" || req.Name == "" {
-		http.Error(w, `{"error":"Email, password, and name are required"}`, http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Email, password, and name are required")
 		return
 	}
 
-	if len(req.Password) < 6 {
-		http.Error(w, `{"error":"Password must be at least 6 characters"}`, http.StatusBadRequest)
+	if !validEmail(req.Email) {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Email address is invalid")
+		return
+	}
+
+	if err := ValidatePassword(req.Password, h.passwordPolicy); err != nil {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
 		return
 	}
 
 	// Check if user already exists
 	var exists bool
-	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", req.Email).Scan(&exists)
+	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE lower(email) = $1)", req.Email).Scan(&exists)
 	if err != nil {
-		http.Error(w, `{"error":"Database error"}`, http.StatusInternalServerError)
+		writeInternalError(w, "Database error", err)
 		return
 	}
 	if exists {
-		http.Error(w, `{"error":"Email already registered"}`, http.StatusConflict)
+		writeJSONError(w, http.StatusConflict, codeConflict, "Email already registered")
 		return
 	}
 
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), h.bcryptCost)
 	if err != nil {
-		http.Error(w, `{"error":"Error hashing password"}`, http.StatusInternalServerError)
+		writeInternalError(w, "Error hashing password", err)
 		return
 	}
 
@@ -82,26 +128,27 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var user models.User
 	err = h.db.QueryRow(
 		`INSERT INTO users (email, name, password) VALUES ($1, $2, $3) 
-		 RETURNING id, email, name, created_at, updated_at`,
+		 RETURNING id, email, name, role, created_at, updated_at`,
 		req.Email, req.Name, string(hashedPassword),
-	).Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
-		http.Error(w, `{"error":"Error creating user"}`, http.StatusInternalServerError)
+		writeInternalError(w, "Error creating user", err)
 		return
 	}
 
-	// Generate JWT token
-	token, err := h.generateToken(user.ID)
+	// Generate JWT and refresh tokens
+	token, refreshToken, err := h.issueTokens(user.ID, user.Role)
 	if err != nil {
-		http.Error(w, `{"error":"Error generating token"}`, http.StatusInternalServerError)
+		writeInternalError(w, "Error generating token", err)
 		return
 	}
 
 	// Return response
 	response := AuthResponse{
-		Token: token,
-		User:  user,
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         user,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -111,66 +158,308 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &req) {
 		return
 	}
 
 	// Validate input
+	req.Email = normalizeEmail(req.Email)
 	if req.Email == "" || req.Password == "" {
-		http.Error(w, `{"error":"Email and password are required"}`, http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Email and password are required")
 		return
 	}
 
 	// Get user from database
 	var user models.User
+	var totpEnabled bool
 	err := h.db.QueryRow(
-		`SELECT id, email, name, password, created_at, updated_at FROM users WHERE email = $1`,
+		`SELECT id, email, name, password, role, totp_enabled, created_at, updated_at FROM users WHERE lower(email) = $1`,
 		req.Email,
-	).Scan(&user.ID, &user.Email, &user.Name, &user.Password, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.Name, &user.Password, &user.Role, &totpEnabled, &user.CreatedAt, &user.UpdatedAt)
 
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error":"Invalid email or password"}`, http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidCredentials, "Invalid email or password")
 		return
 	}
 	if err != nil {
-		http.Error(w, `{"error":"Database error"}`, http.StatusInternalServerError)
+		writeInternalError(w, "Database error", err)
 		return
 	}
 
 	// Verify password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	if err != nil {
-		http.Error(w, `{"error":"Invalid email or password"}`, http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidCredentials, "Invalid email or password")
+		return
+	}
+	h.upgradePasswordHash(user.ID, user.Password, req.Password)
+
+	// With two-factor authentication enabled, tokens are only issued once a
+	// code is validated against the challenge
+	if totpEnabled {
+		challengeToken, err := h.generateChallengeToken(user.ID)
+		if err != nil {
+			writeInternalError(w, "Error generating token", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challengeToken,
+		})
 		return
 	}
 
-	// Generate JWT token
-	token, err := h.generateToken(user.ID)
+	// Generate JWT and refresh tokens
+	token, refreshToken, err := h.issueTokens(user.ID, user.Role)
 	if err != nil {
-		http.Error(w, `{"error":"Error generating token"}`, http.StatusInternalServerError)
+		writeInternalError(w, "Error generating token", err)
 		return
 	}
 
 	// Return response
 	response := AuthResponse{
-		Token: token,
-		User:  user,
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         user,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (h *AuthHandler) generateToken(userID string) (string, error) {
+// Me returns the authenticated user's profile
+func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var user models.User
+	err := h.db.QueryRow(
+		`SELECT id, email, name, role, created_at, updated_at FROM users WHERE id = $1`,
+		userID,
+	).Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.CreatedAt, &user.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// Refresh exchanges a valid refresh token for a new access token and refresh
+// token. Each refresh token can only be used once.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.RefreshToken == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Refresh token is required")
+		return
+	}
+
+	tokenHash := hashToken(req.RefreshToken)
+
+	var userID, role string
+	var expired, used bool
+	err := h.db.QueryRow(
+		`SELECT rt.user_id, u.role, rt.expires_at <= CURRENT_TIMESTAMP, rt.used_at IS NOT NULL
+		 FROM refresh_tokens rt
+		 JOIN users u ON u.id = rt.user_id
+		 WHERE rt.token_hash = $1`,
+		tokenHash,
+	).Scan(&userID, &role, &expired, &used)
+
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	if used {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Refresh token has already been used")
+		return
+	}
+	if expired {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Refresh token has expired")
+		return
+	}
+
+	// Mark the token used, guarding against a concurrent refresh with the same token
+	result, err := h.db.Exec(
+		`UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = $1 AND used_at IS NULL`,
+		tokenHash,
+	)
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Refresh token has already been used")
+		return
+	}
+
+	token, refreshToken, err := h.issueTokens(userID, role)
+	if err != nil {
+		writeInternalError(w, "Error generating token", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+	})
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Logout revokes the access token used for the request and, if one is given,
+// the session's refresh token
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req LogoutRequest
+	if r.ContentLength != 0 && !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	// Keep the token denied until it would have expired anyway
+	if jti, _ := r.Context().Value(middleware.TokenIDKey).(string); jti != "" {
+		_, err := h.db.Exec(
+			`INSERT INTO revoked_tokens (jti, expires_at)
+			 VALUES ($1, CURRENT_TIMESTAMP + $2 * INTERVAL '1 second')
+			 ON CONFLICT (jti) DO NOTHING`,
+			jti, int(h.accessTokenTTL.Seconds()),
+		)
+		if err != nil {
+			writeInternalError(w, "Database error", err)
+			return
+		}
+	}
+
+	if req.RefreshToken != "" {
+		_, err := h.db.Exec(
+			`UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP
+			 WHERE token_hash = $1 AND user_id = $2 AND used_at IS NULL`,
+			hashToken(req.RefreshToken), userID,
+		)
+		if err != nil {
+			writeInternalError(w, "Database error", err)
+			return
+		}
+	}
+
+	// Expired entries no longer need to be denied
+	_, _ = h.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at <= CURRENT_TIMESTAMP`)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// IsTokenRevoked reports whether an access token was revoked by logging out,
+// or along with the rest of its user's tokens by deleting the account or
+// resetting the password. Tokens only carry their issue time to the second,
+// so tokens issued in the same second as a reset remain valid.
+func (h *AuthHandler) IsTokenRevoked(userID, jti string, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	err := h.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1 AND expires_at > CURRENT_TIMESTAMP)
+		     OR NOT EXISTS(
+		         SELECT 1 FROM users
+		         WHERE id = $2 AND (tokens_valid_after IS NULL OR tokens_valid_after <= to_timestamp($3))
+		     )`,
+		jti, userID, issuedAt.Unix(),
+	).Scan(&revoked)
+	return revoked, err
+}
+
+// issueTokens creates a short-lived access token and a stored refresh token
+func (h *AuthHandler) issueTokens(userID, role string) (string, string, error) {
+	token, err := h.generateToken(userID, role)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := generateRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = h.db.Exec(
+		`INSERT INTO refresh_tokens (user_id, token_hash, expires_at)
+		 VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second')`,
+		userID, hashToken(refreshToken), int(h.refreshTokenTTL.Seconds()),
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+// normalizeEmail trims and lowercases an email so that addresses differing
+// only in case refer to the same account
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validEmail reports whether email is a bare address such as user@example.com
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// generateRandomToken returns a URL-safe random token for single-use secrets
+func generateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash under which a secret token is stored, so a
+// database leak does not expose usable tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *AuthHandler) generateToken(userID, role string) (string, error) {
+	// The token ID lets a single token be revoked on logout
+	jti, err := generateRandomToken()
+	if err != nil {
+		return "", err
+	}
+
 	claims := jwt.MapClaims{
+		"jti":     jti,
 		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 days
+		"role":    role,
+		"exp":     time.Now().Add(h.accessTokenTTL).Unix(),
 		"iat":     time.Now().Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(h.jwtSecret))
+	return h.keys.Sign(claims)
 }
 
 // GetUserID extracts user ID from request context
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/diyorend/dashGPT-backend/dbtest"
+)
+
+func TestEmailsAreCaseInsensitive(t *testing.T) {
+	db := dbtest.Open(t)
+	router := authRouter(newTestAuthHandler(db))
+
+	body, _ := json.Marshal(RegisterRequest{Email: " Mixed.Case@Example.COM ", Password: testPassword, Name: "Mixed Case"})
+	w := serveWithToken(router, "", http.MethodPost, "/api/auth/register", string(body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register: status = %d, want %d; body: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var registered AuthResponse
+	if err := json.NewDecoder(w.Body).Decode(&registered); err != nil {
+		t.Fatalf("decoding register response: %v", err)
+	}
+	if registered.User.Email != "mixed.case@example.com" {
+		t.Errorf("registered email = %q, want it normalized", registered.User.Email)
+	}
+
+	for _, email := range []string{"mixed.case@example.com", "MIXED.CASE@EXAMPLE.COM"} {
+		body, _ := json.Marshal(LoginRequest{Email: email, Password: testPassword})
+		w := serveWithToken(router, "", http.MethodPost, "/api/auth/login", string(body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("login as %s: status = %d, want %d; body: %s", email, w.Code, http.StatusOK, w.Body)
+		}
+		var loggedIn AuthResponse
+		if err := json.NewDecoder(w.Body).Decode(&loggedIn); err != nil {
+			t.Fatalf("decoding login response: %v", err)
+		}
+		if loggedIn.User.ID != registered.User.ID {
+			t.Errorf("login as %s: user = %s, want %s", email, loggedIn.User.ID, registered.User.ID)
+		}
+	}
+
+	body, _ = json.Marshal(RegisterRequest{Email: "MIXED.case@example.com", Password: testPassword, Name: "Duplicate"})
+	if w := serveWithToken(router, "", http.MethodPost, "/api/auth/register", string(body)); w.Code != http.StatusConflict {
+		t.Errorf("registering the address in another case: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheableTemperature is the highest temperature for which responses are
+// cached. Above it, answers are expected to vary and replaying one would be stale.
+const maxCacheableTemperature = 0.2
+
+// maxResponseCacheEntries bounds the cache's memory between cleanups
+const maxResponseCacheEntries = 1000
+
+type cacheEntry struct {
+	key       string
+	text      string
+	expiresAt time.Time
+}
+
+// responseCache is an in-memory cache of assistant responses keyed by a hash
+// of the request that produced them. Once full, the oldest entry is evicted.
+type responseCache struct {
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List // of *cacheEntry, newest first
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	c := &responseCache{
+		ttl:        ttl,
+		maxEntries: maxResponseCacheEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+
+	// Cleanup expired entries periodically
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.mu.Lock()
+			for _, elem := range c.entries {
+				if time.Now().After(elem.Value.(*cacheEntry).expiresAt) {
+					c.remove(elem)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}()
+
+	return c
+}
+
+func (c *responseCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.remove(elem)
+		return "", false
+	}
+	return entry.text, true
+}
+
+func (c *responseCache) set(key, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for len(c.entries) >= c.maxEntries {
+		c.remove(c.order.Back())
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		key:       key,
+		text:      text,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+}
+
+// remove deletes an entry. c.mu must be held.
+func (c *responseCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// responseCacheKey hashes the parts of a completion request that determine its output
+func responseCacheKey(opts CompletionOptions, messages []LLMMessage) string {
+	data, _ := json.Marshal(struct {
+		Model       string       `json:"model"`
+		MaxTokens   int          `json:"max_tokens"`
+		Temperature float64      `json:"temperature"`
+		System      string       `json:"system"`
+		Messages    []LLMMessage `json:"messages"`
+	}{opts.Model, opts.MaxTokens, opts.Temperature, opts.System, messages})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// splitForReplay breaks a cached response into word-sized chunks so it can be
+// replayed to the client as if it were streamed
+func splitForReplay(text string) []string {
+	var chunks []string
+	for len(text) > 0 {
+		i := strings.IndexAny(text[1:], " \n")
+		if i == -1 {
+			chunks = append(chunks, text)
+			break
+		}
+		chunks = append(chunks, text[:i+1])
+		text = text[i+1:]
+	}
+	return chunks
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResponseCacheKey(t *testing.T) {
+	baseOpts := CompletionOptions{Model: defaultModel, MaxTokens: 1024, Temperature: 0, System: "Be brief."}
+	baseMessages := func() []LLMMessage {
+		return []LLMMessage{
+			{Role: "user", Content: "What is 2+2?"},
+			{Role: "assistant", Content: "4"},
+			{Role: "user", Content: "And 3+3?"},
+		}
+	}
+	base := responseCacheKey(baseOpts, baseMessages())
+
+	tests := []struct {
+		name     string
+		change   func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage
+		wantSame bool
+	}{
+		{
+			name:     "identical request",
+			change:   func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage { return messages },
+			wantSame: true,
+		},
+		{
+			name: "model",
+			change: func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage {
+				opts.Model = "claude-3-5-haiku-20241022"
+				return messages
+			},
+		},
+		{
+			name: "max tokens",
+			change: func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage {
+				opts.MaxTokens = 16
+				return messages
+			},
+		},
+		{
+			name: "temperature",
+			change: func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage {
+				opts.Temperature = 0.1
+				return messages
+			},
+		},
+		{
+			name: "system prompt",
+			change: func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage {
+				opts.System = "Be thorough."
+				return messages
+			},
+		},
+		{
+			name: "message content",
+			change: func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage {
+				messages[2].Content = "And 4+4?"
+				return messages
+			},
+		},
+		{
+			name: "earlier turn",
+			change: func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage {
+				messages[1].Content = "Four"
+				return messages
+			},
+		},
+		{
+			name: "image",
+			change: func(opts *CompletionOptions, messages []LLMMessage) []LLMMessage {
+				messages[2].Images = []Image{{MediaType: "image/png", Data: []byte{1, 2, 3}}}
+				return messages
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := baseOpts
+			messages := tt.change(&opts, baseMessages())
+			if same := responseCacheKey(opts, messages) == base; same != tt.wantSame {
+				t.Errorf("same key = %t, want %t", same, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	cache := newResponseCache(ttl)
+
+	if _, ok := cache.get("key"); ok {
+		t.Fatal("hit on an empty cache")
+	}
+
+	cache.set("key", "cached reply")
+	if text, ok := cache.get("key"); !ok || text != "cached reply" {
+		t.Fatalf("get = %q, %t; want a hit", text, ok)
+	}
+	if _, ok := cache.get("other"); ok {
+		t.Error("hit for a key that was never set")
+	}
+
+	time.Sleep(2 * ttl)
+	if _, ok := cache.get("key"); ok {
+		t.Error("hit after the TTL expired")
+	}
+	cache.mu.Lock()
+	_, kept := cache.entries["key"]
+	cache.mu.Unlock()
+	if kept {
+		t.Error("expired entry was kept after a miss")
+	}
+}
+
+func TestResponseCacheEvictsOldest(t *testing.T) {
+	cache := newResponseCache(time.Minute)
+	cache.maxEntries = 3
+
+	for _, key := range []string{"a", "b", "c"} {
+		cache.set(key, "reply "+key)
+	}
+	// Setting an existing key makes it the newest rather than growing the cache
+	cache.set("a", "new reply a")
+	cache.set("d", "reply d")
+	cache.set("e", "reply e")
+
+	for key, want := range map[string]string{"a": "new reply a", "d": "reply d", "e": "reply e"} {
+		if text, ok := cache.get(key); !ok || text != want {
+			t.Errorf("get(%q) = %q, %t; want %q", key, text, ok, want)
+		}
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := cache.get(key); ok {
+			t.Errorf("hit for %q, want it evicted", key)
+		}
+	}
+
+	cache.mu.Lock()
+	n, listed := len(cache.entries), cache.order.Len()
+	cache.mu.Unlock()
+	if n != 3 || listed != 3 {
+		t.Errorf("cache holds %d entries (%d listed), want 3", n, listed)
+	}
+}
@@ -1,287 +1,823 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/diyorend/dashGPT-backend/config"
+	"github.com/diyorend/dashGPT-backend/metrics"
 	"github.com/diyorend/dashGPT-backend/models"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultModel       = "claude-sonnet-4-20250514"
+	defaultMaxTokens   = 4096
+	defaultTemperature = 0.7
+	maxTokensCap       = 8192
 )
 
 type ChatHandler struct {
-	db           *sql.DB
-	claudeAPIKey string
-	claudeAPIURL string
+	db                *sql.DB
+	provider          LLMProvider
+	moderator         Moderator
+	cache             *responseCache
+	disclaimers       *Disclaimers
+	tokenQuota        int64
+	maxMessageLength  int
+	contextBudget     int
+	prices            map[string]config.ModelPrice
+	maxStreamsPerIP   int
+	maxStreams        int
+	heartbeatInterval time.Duration
+	idempotencyKeyTTL time.Duration
+	streams           *streamRegistry
 }
 
-func NewChatHandler(db *sql.DB, claudeAPIKey string) *ChatHandler {
-	return &ChatHandler{
-		db:           db,
-		claudeAPIKey: claudeAPIKey,
-		claudeAPIURL: "https://api.anthropic.com/v1/messages",
+// NewChatHandler creates a chat handler. A positive response cache TTL
+// enables caching of low-temperature responses for identical prompt histories,
+// disclaimers for the configured categories are appended to matching
+// responses, and positive limits cap each user's monthly token usage and the
+// characters in a single message. A positive context budget caps the history
+// sent with each request. A positive heartbeat interval sends keepalives on
+// streams still waiting for their first token. User messages are screened by
+// moderator, or all allowed if it is nil.
+func NewChatHandler(db *sql.DB, provider LLMProvider, moderator Moderator, cfg config.Chat) *ChatHandler {
+	if moderator == nil {
+		moderator = NoopModerator{}
+	}
+	h := &ChatHandler{
+		db:                db,
+		provider:          provider,
+		moderator:         moderator,
+		tokenQuota:        cfg.MonthlyTokenQuota,
+		maxMessageLength:  cfg.MaxMessageLength,
+		contextBudget:     cfg.ContextTokenBudget,
+		prices:            cfg.ModelPrices,
+		maxStreamsPerIP:   cfg.MaxStreamsPerIP,
+		maxStreams:        cfg.MaxStreams,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		idempotencyKeyTTL: cfg.IdempotencyKeyTTL,
+		streams:           newStreamRegistry(),
+	}
+	if cfg.ResponseCacheTTL > 0 {
+		h.cache = newResponseCache(cfg.ResponseCacheTTL)
 	}
+	if len(cfg.Disclaimers) > 0 {
+		h.disclaimers = NewDefaultDisclaimers(cfg.Disclaimers)
+	}
+	return h
 }
 
 type ChatRequest struct {
 	Message        string `json:"message"`
 	ConversationID string `json:"conversationId,omitempty"`
+	Model          string `json:"model,omitempty"`
+	// Settings are stored on the conversation and may only be set when creating one
+	ConversationSettings
+	// SystemPromptOverride applies to this message only. It takes precedence
+	// over the conversation's system prompt and is never persisted.
+	SystemPromptOverride string `json:"systemPromptOverride,omitempty"`
+	// ContextMessageIDs and ContextWindow restrict which prior messages are
+	// sent to Claude. At most one may be set; by default the full history is sent.
+	ContextMessageIDs []string `json:"contextMessageIds,omitempty"`
+	ContextWindow     int      `json:"contextWindow,omitempty"`
+	// Images are base64-encoded images sent along with the message
+	Images []Image `json:"images,omitempty"`
 }
 
-type ClaudeMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+// ConversationSettings are per-conversation generation settings. Unset values
+// fall back to the defaults.
+type ConversationSettings struct {
+	MaxTokens    *int     `json:"maxTokens,omitempty"`
+	Temperature  *float64 `json:"temperature,omitempty"`
+	SystemPrompt *string  `json:"systemPrompt,omitempty"`
 }
 
-type ClaudeRequest struct {
-	Model       string          `json:"model"`
-	MaxTokens   int             `json:"max_tokens"`
-	Messages    []ClaudeMessage `json:"messages"`
-	Stream      bool            `json:"stream"`
-	Temperature float64         `json:"temperature,omitempty"`
+const maxSystemPromptLength = 10000
+
+func (s ConversationSettings) isSet() bool {
+	return s.MaxTokens != nil || s.Temperature != nil || s.SystemPrompt != nil
 }
 
-type ClaudeResponse struct {
-	ID      string `json:"id"`
-	Type    string `json:"type"`
-	Role    string `json:"role"`
-	Content []struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
-	} `json:"content"`
-	Model      string `json:"model"`
-	StopReason string `json:"stop_reason"`
-	Usage      struct {
-		InputTokens  int `json:"input_tokens"`
-		OutputTokens int `json:"output_tokens"`
-	} `json:"usage"`
+// validate returns an error message for invalid settings, or "" if they are valid
+func (s ConversationSettings) validate() string {
+	if s.MaxTokens != nil && (*s.MaxTokens < 1 || *s.MaxTokens > maxTokensCap) {
+		return fmt.Sprintf("maxTokens must be between 1 and %d", maxTokensCap)
+	}
+	if s.Temperature != nil && (*s.Temperature < 0 || *s.Temperature > 1) {
+		return "temperature must be between 0 and 1"
+	}
+	if s.SystemPrompt != nil && len(*s.SystemPrompt) > maxSystemPromptLength {
+		return fmt.Sprintf("systemPrompt must be at most %d characters", maxSystemPromptLength)
+	}
+	return ""
 }
 
 type StreamEvent struct {
 	Type           string `json:"type"`
 	Text           string `json:"text,omitempty"`
 	ConversationID string `json:"conversationId,omitempty"`
+	Title          string `json:"title,omitempty"`
+	StopReason     string `json:"stopReason,omitempty"`
+	// RequestID is sent with errors so they can be matched to server logs
+	RequestID string `json:"requestId,omitempty"`
 }
 
 func (h *ChatHandler) SendMessage(w http.ResponseWriter, r *http.Request) {
 	userID := GetUserID(r)
 	if userID == "" {
-		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
 		return
 	}
 
 	var req ChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &req) {
 		return
 	}
 
-	if req.Message == "" {
-		http.Error(w, `{"error":"Message is required"}`, http.StatusBadRequest)
+	// Retried requests carrying the same Idempotency-Key get the original
+	// reply instead of saving the message and calling the model again
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+		claimed, err := h.claimIdempotencyKey(userID, key)
+		if err != nil {
+			writeInternalError(w, "Error processing message", err)
+			return
+		}
+		if !claimed {
+			h.replayIdempotentReply(w, r, userID, key)
+			return
+		}
+	}
+
+	reply, chatErr := h.prepareReply(r.Context(), userID, req)
+	if chatErr != nil {
+		if key != "" {
+			h.releaseIdempotencyKey(userID, key)
+		}
+		chatErr.write(w)
 		return
 	}
+	reply.idempotencyKey = key
+	h.streamReply(r.Context(), newSSESink(w), reply)
+}
+
+// prepareReply validates a chat request, saves the user's message, creating
+// the conversation if needed, and returns the reply to stream. It is shared by
+// the SSE and WebSocket transports.
+func (h *ChatHandler) prepareReply(ctx context.Context, userID string, req ChatRequest) (replyRequest, *chatError) {
+	badRequest := func(message string) (replyRequest, *chatError) {
+		return replyRequest{}, &chatError{status: http.StatusBadRequest, code: codeInvalidRequest, message: message}
+	}
+	serverError := func(message string) (replyRequest, *chatError) {
+		return replyRequest{}, &chatError{status: http.StatusInternalServerError, code: codeInternal, message: message}
+	}
+
+	if req.Message == "" {
+		return badRequest("Message is required")
+	}
+	if chatErr := h.messageLengthError(req.Message); chatErr != nil {
+		return replyRequest{}, chatErr
+	}
+	if msg := validateImages(req.Images); msg != "" {
+		return badRequest(msg)
+	}
+
+	if req.Model != "" && !isAllowedModel(req.Model) {
+		return badRequest("Unsupported model")
+	}
+
+	if req.ConversationID != "" && req.ConversationSettings.isSet() {
+		return badRequest("maxTokens, temperature and systemPrompt can only be set when creating a conversation")
+	}
+	if msg := req.ConversationSettings.validate(); msg != "" {
+		return badRequest(msg)
+	}
+	if len(req.SystemPromptOverride) > maxSystemPromptLength {
+		return badRequest(fmt.Sprintf("systemPromptOverride must be at most %d characters", maxSystemPromptLength))
+	}
+
+	// Values the request leaves unset fall back to the user's defaults, then
+	// to the global defaults
+	defaults, err := h.getUserSettings(userID)
+	if err != nil {
+		slog.Error("Error fetching user settings", "error", err, "request_id", chimiddleware.GetReqID(ctx))
+		return serverError("Error fetching settings")
+	}
+	model := resolveModel(req.Model, defaults)
+	if req.ConversationID == "" {
+		if req.Temperature == nil {
+			req.Temperature = defaults.Temperature
+		}
+		if req.SystemPrompt == nil {
+			req.SystemPrompt = defaults.SystemPrompt
+		}
+	}
+
+	if req.ConversationID != "" {
+		owned, err := h.userOwnsConversation(userID, req.ConversationID)
+		if err != nil {
+			slog.Error("Error fetching conversation", "error", err, "request_id", chimiddleware.GetReqID(ctx))
+			return serverError("Error fetching conversation")
+		}
+		if !owned {
+			return replyRequest{}, &chatError{status: http.StatusNotFound, code: codeNotFound, message: "Conversation not found"}
+		}
+	}
+
+	if len(req.ContextMessageIDs) > 0 && req.ContextWindow != 0 {
+		return badRequest("Only one of contextMessageIds and contextWindow may be set")
+	}
+	if req.ContextWindow < 0 {
+		return badRequest("contextWindow must be positive")
+	}
+	if len(req.ContextMessageIDs) > 0 {
+		if req.ConversationID == "" {
+			return badRequest("contextMessageIds requires a conversationId")
+		}
+
+		var found int
+		err := h.db.QueryRow(
+			`SELECT COUNT(*) FROM messages WHERE conversation_id = $1 AND id = ANY($2) AND deleted_at IS NULL`,
+			req.ConversationID, pq.Array(req.ContextMessageIDs),
+		).Scan(&found)
+		if err != nil && !isInvalidID(err) {
+			slog.Error("Error fetching context messages", "error", err, "request_id", chimiddleware.GetReqID(ctx))
+			return serverError("Error fetching conversation history")
+		}
+		if err != nil || found != len(req.ContextMessageIDs) {
+			return badRequest("contextMessageIds must reference messages in this conversation")
+		}
+	}
+
+	// Enforce the monthly token quota before spending anything
+	if chatErr := h.quotaError(userID); chatErr != nil {
+		return replyRequest{}, chatErr
+	}
+
+	// Blocked messages are neither saved nor sent
+	if chatErr := h.moderationError(ctx, req.Message); chatErr != nil {
+		return replyRequest{}, chatErr
+	}
 
 	// Get or create conversation
 	conversationID := req.ConversationID
 	if conversationID == "" {
 		var err error
-		conversationID, err = h.createConversation(userID, req.Message)
+		conversationID, err = h.createConversation(userID, req.Message, req.ConversationSettings)
 		if err != nil {
-			http.Error(w, `{"error":"Error creating conversation"}`, http.StatusInternalServerError)
-			return
+			return serverError("Error creating conversation")
 		}
 	}
 
-	// Save user message
-	_, err := h.db.Exec(
-		`INSERT INTO messages (conversation_id, role, content) VALUES ($1, $2, $3)`,
-		conversationID, "user", req.Message,
-	)
-	if err != nil {
-		http.Error(w, `{"error":"Error saving message"}`, http.StatusInternalServerError)
-		return
+	// Save user message along with any images
+	if err := h.saveUserMessage(conversationID, req.Message, req.Images); err != nil {
+		return serverError("Error saving message")
 	}
 
 	// Get conversation history
 	messages, err := h.getConversationMessages(conversationID)
 	if err != nil {
-		http.Error(w, `{"error":"Error fetching conversation history"}`, http.StatusInternalServerError)
-		return
+		return serverError("Error fetching conversation history")
+	}
+	messages = selectContextMessages(messages, req.ContextMessageIDs, req.ContextWindow)
+
+	settings, err := h.getGenerationSettings(conversationID)
+	if err != nil {
+		return serverError("Error fetching conversation settings")
+	}
+
+	systemPrompt := settings.systemPrompt
+	if req.SystemPromptOverride != "" {
+		systemPrompt = req.SystemPromptOverride
+	}
+
+	reply := replyRequest{
+		userID:         userID,
+		conversationID: conversationID,
+		history:        messages,
+		opts: CompletionOptions{
+			Model:       model,
+			MaxTokens:   settings.maxTokens,
+			Temperature: settings.temperature,
+			System:      systemPrompt,
+		},
+		useCache: true,
+	}
+	if req.ConversationID == "" {
+		reply.titleFrom = req.Message
+	}
+	return reply, nil
+}
+
+// saveUserMessage saves a user message and its images in a single transaction
+func (h *ChatHandler) saveUserMessage(conversationID, content string, images []Image) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var messageID string
+	err = tx.QueryRow(
+		`INSERT INTO messages (conversation_id, role, content) VALUES ($1, $2, $3) RETURNING id`,
+		conversationID, "user", content,
+	).Scan(&messageID)
+	if err != nil {
+		return err
 	}
 
-	// Prepare Claude API request
-	claudeMessages := make([]ClaudeMessage, len(messages))
-	for i, msg := range messages {
-		claudeMessages[i] = ClaudeMessage{
+	for _, image := range images {
+		_, err := tx.Exec(
+			`INSERT INTO message_attachments (message_id, media_type, size, data) VALUES ($1, $2, $3, $4)`,
+			messageID, image.MediaType, len(image.Data), image.Data,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// replyRequest describes an assistant reply to stream
+type replyRequest struct {
+	userID         string
+	conversationID string
+	history        []models.Message
+	opts           CompletionOptions
+	// useCache allows answering from the response cache; regeneration skips it
+	// so the user gets a fresh reply
+	useCache bool
+	// titleFrom is the first user message of a new conversation, which is
+	// named after the exchange once the reply completes
+	titleFrom string
+	// continueMessageID is a truncated assistant message, the last in history,
+	// that the reply is appended to instead of being saved as a new message
+	continueMessageID string
+	// idempotencyKey is the client's key for the request, if it sent one
+	idempotencyKey string
+}
+
+// streamReply streams an assistant reply to the client and saves it to the
+// conversation. ctx is cancelled when the client goes away.
+func (h *ChatHandler) streamReply(ctx context.Context, sink streamSink, reply replyRequest) {
+	userID, conversationID, opts := reply.userID, reply.conversationID, reply.opts
+	// Conversation settings may ask for more than a model can generate
+	opts.MaxTokens = min(opts.MaxTokens, maxReplyTokens(opts.Model))
+
+	// Chat logs and error events carry the request ID so a client-reported
+	// error can be found in the server logs
+	requestID := chimiddleware.GetReqID(ctx)
+	log := slog.With("request_id", requestID, "user_id", userID, "conversation_id", conversationID)
+	errorEvent := func(text string) StreamEvent {
+		return StreamEvent{Type: "error", Text: text, ConversationID: conversationID, RequestID: requestID}
+	}
+
+	// The user may stop the reply through StopGeneration
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer h.streams.register(userID, conversationID, cancel)()
+
+	history := alternateRoles(trimToContextWindow(reply.history, h.historyBudget(opts)))
+
+	// Prepare completion request
+	llmMessages := make([]LLMMessage, len(history))
+	for i, msg := range history {
+		llmMessages[i] = LLMMessage{
 			Role:    msg.Role,
 			Content: msg.Content,
 		}
+		for _, a := range msg.Attachments {
+			llmMessages[i].Images = append(llmMessages[i].Images, Image{MediaType: a.MediaType, Data: a.Data})
+		}
 	}
 
-	claudeReq := ClaudeRequest{
-		Model:       "claude-sonnet-4-20250514",
-		MaxTokens:   4096,
-		Messages:    claudeMessages,
-		Stream:      true,
-		Temperature: 0.7,
+	// Send initial event with conversation ID
+	sink.send(StreamEvent{Type: "start", ConversationID: conversationID})
+
+	// Identical low-temperature requests can be answered from the cache
+	var cacheKey string
+	if reply.useCache && h.cache != nil && opts.Temperature <= maxCacheableTemperature {
+		cacheKey = responseCacheKey(opts, llmMessages)
 	}
 
-	// Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var assistantResponse, stopReason string
+	var draft *replyDraft
+	var err error
 
-	// Send initial event with conversation ID
-	fmt.Fprintf(w, "data: %s\n\n", formatStreamEvent("start", "", conversationID))
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
+	// Record the saved reply against the request's idempotency key so retries
+	// get it back. If nothing was saved, the key is released so a retry starts over.
+	var saved bool
+	if reply.idempotencyKey != "" {
+		defer func() {
+			if saved {
+				h.completeIdempotencyKey(reply, assistantResponse, stopReason)
+			} else {
+				h.releaseIdempotencyKey(reply.userID, reply.idempotencyKey)
+			}
+		}()
 	}
 
-	// Call Claude API with streaming
-	assistantResponse, err := h.streamClaudeResponse(w, claudeReq)
-	if err != nil {
-		fmt.Fprintf(w, "data: %s\n\n", formatStreamEvent("error", err.Error(), conversationID))
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+	if cached, ok := h.cachedResponse(cacheKey); ok {
+		assistantResponse = cached
+		for _, chunk := range splitForReplay(cached) {
+			sink.send(StreamEvent{Type: "content", Text: chunk})
+		}
+	} else {
+		draft, err = h.startReply(reply, log)
+		if err != nil {
+			log.Error("Error saving response", "error", err)
+			sink.send(errorEvent("Error saving response"))
+			return
+		}
+
+		// Call the model with streaming
+		log.Debug("Claude request started", "model", opts.Model, "messages", len(llmMessages))
+		start := time.Now()
+		var usage Usage
+		assistantResponse, usage, stopReason, err = h.streamCompletion(ctx, sink, llmMessages, opts, draft)
+		log.Info("Claude request finished",
+			"model", opts.Model,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"input_tokens", usage.InputTokens,
+			"output_tokens", usage.OutputTokens,
+			"stop_reason", stopReason,
+		)
+		if usage != (Usage{}) {
+			if err := h.recordUsage(userID, opts.Model, usage); err != nil {
+				log.Error("Error recording usage", "error", err)
+			}
+			metrics.ChatTokens.WithLabelValues(opts.Model, "input").Add(float64(usage.InputTokens))
+			metrics.ChatTokens.WithLabelValues(opts.Model, "output").Add(float64(usage.OutputTokens))
+		}
+		// A stopped reply ends normally with the text generated so far, unless
+		// there is none
+		stopped := errors.Is(context.Cause(ctx), errGenerationStopped)
+		if stopped && assistantResponse != "" {
+			err = nil
+		}
+		if err != nil && ctx.Err() != nil && !stopped {
+			// The client went away mid-stream; keep the partial reply so the
+			// conversation isn't left without a response
+			if assistantResponse != "" {
+				saved = draft.finish(assistantResponse, "") == nil
+				_, _ = h.db.Exec(`UPDATE conversations SET updated_at = CURRENT_TIMESTAMP WHERE id = $1`, conversationID)
+			} else {
+				draft.discard()
+			}
+			return
+		}
+		if stopped && err != nil {
+			draft.discard()
+			sink.send(StreamEvent{Type: "end", ConversationID: conversationID})
+			return
+		}
+		if err != nil {
+			draft.discard()
+			log.Error("Completion failed", "error", err)
+			sink.send(errorEvent(userFacingError(err)))
+			return
+		}
+		// Truncated replies aren't cached so they can't be replayed as complete
+		if cacheKey != "" && stopReason != "max_tokens" && !stopped {
+			h.cache.set(cacheKey, assistantResponse)
 		}
-		return
 	}
 
-	// Save assistant response
-	_, err = h.db.Exec(
-		`INSERT INTO messages (conversation_id, role, content) VALUES ($1, $2, $3)`,
-		conversationID, "assistant", assistantResponse,
-	)
-	if err != nil {
-		fmt.Fprintf(w, "data: %s\n\n", formatStreamEvent("error", "Error saving response", conversationID))
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+	// Append any compliance disclaimers so they are shown and persisted
+	if h.disclaimers != nil {
+		if notice := h.disclaimers.For(assistantResponse); notice != "" {
+			assistantResponse += notice
+			sink.send(StreamEvent{Type: "content", Text: notice})
 		}
+	}
+
+	// Cached replies weren't streamed, so their message is only created now
+	if draft == nil {
+		draft, err = h.startReply(reply, log)
+	}
+	if err == nil {
+		err = draft.finish(assistantResponse, stopReason)
+	}
+	if err != nil {
+		log.Error("Error saving response", "error", err)
+		sink.send(errorEvent("Error saving response"))
 		return
 	}
+	saved = true
 
 	// Update conversation timestamp
 	_, _ = h.db.Exec(`UPDATE conversations SET updated_at = CURRENT_TIMESTAMP WHERE id = $1`, conversationID)
 
+	// Name new conversations after their first exchange. Generation continues in
+	// the background if it is slow, but the end event only waits briefly for it.
+	endEvent := StreamEvent{Type: "end", ConversationID: conversationID, StopReason: stopReason}
+	if reply.titleFrom != "" {
+		titleCh := make(chan string, 1)
+		go func() {
+			titleCh <- h.generateTitle(conversationID, reply.titleFrom, assistantResponse)
+		}()
+
+		select {
+		case endEvent.Title = <-titleCh:
+		case <-time.After(titleWaitTimeout):
+		}
+	}
+
 	// Send end event
-	fmt.Fprintf(w, "data: %s\n\n", formatStreamEvent("end", "", conversationID))
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
+	sink.send(endEvent)
+}
+
+const (
+	titleModel       = "claude-3-5-haiku-20241022"
+	titleWaitTimeout = 5 * time.Second
+)
+
+// How often a streaming reply's text is written to its message: after
+// replyFlushInterval, or sooner once replyFlushBytes of new text arrive
+const (
+	replyFlushInterval = 2 * time.Second
+	replyFlushBytes    = 4096
+)
+
+// replyDraft is the assistant message a reply is saved to while it streams,
+// so a partial reply survives the server crashing mid-stream. Until the reply
+// finishes, the message has no stop reason.
+type replyDraft struct {
+	db        *sql.DB
+	log       *slog.Logger
+	messageID string
+	// base is the content of a continued message before the reply; a new
+	// message starts empty
+	base       string
+	isNew      bool
+	flushedLen int
+	flushedAt  time.Time
+}
+
+// startReply creates the message a reply is saved to, along with the model
+// that produced it. A continuation is saved to the message it continues.
+func (h *ChatHandler) startReply(reply replyRequest, log *slog.Logger) (*replyDraft, error) {
+	d := &replyDraft{db: h.db, log: log, flushedAt: time.Now()}
+
+	if reply.continueMessageID != "" {
+		d.messageID = reply.continueMessageID
+		err := h.db.QueryRow(`SELECT content FROM messages WHERE id = $1`, d.messageID).Scan(&d.base)
+		return d, err
 	}
+
+	d.isNew = true
+	err := h.db.QueryRow(
+		`INSERT INTO messages (conversation_id, role, content, model) VALUES ($1, $2, '', $3) RETURNING id`,
+		reply.conversationID, "assistant", reply.opts.Model,
+	).Scan(&d.messageID)
+	return d, err
 }
 
-func (h *ChatHandler) streamClaudeResponse(w http.ResponseWriter, claudeReq ClaudeRequest) (string, error) {
-	reqBody, err := json.Marshal(claudeReq)
+// flush saves the text received so far if enough time has passed or enough
+// text has arrived since the last write. Failures are logged; the final write
+// in finish still saves the whole reply.
+func (d *replyDraft) flush(text string) {
+	if len(text)-d.flushedLen < replyFlushBytes && time.Since(d.flushedAt) < replyFlushInterval {
+		return
+	}
+	if len(text) == d.flushedLen {
+		return
+	}
+
+	if _, err := d.db.Exec(`UPDATE messages SET content = $1 WHERE id = $2`, d.base+text, d.messageID); err != nil {
+		d.log.Error("Error saving partial reply", "error", err, "message_id", d.messageID)
+	}
+	d.flushedLen = len(text)
+	d.flushedAt = time.Now()
+}
+
+// finish saves the whole reply and why it stopped, so truncated replies can
+// be continued. An unknown stop reason keeps the message's previous one.
+func (d *replyDraft) finish(text, stopReason string) error {
+	_, err := d.db.Exec(
+		`UPDATE messages SET content = $1, stop_reason = COALESCE(NULLIF($2, ''), stop_reason) WHERE id = $3`,
+		d.base+text, stopReason, d.messageID,
+	)
+	return err
+}
+
+// discard removes a reply that produced nothing worth keeping, restoring a
+// continued message to its previous content
+func (d *replyDraft) discard() {
+	var err error
+	if d.isNew {
+		_, err = d.db.Exec(`DELETE FROM messages WHERE id = $1`, d.messageID)
+	} else if d.flushedLen > 0 {
+		_, err = d.db.Exec(`UPDATE messages SET content = $1 WHERE id = $2`, d.base, d.messageID)
+	}
 	if err != nil {
-		return "", err
+		d.log.Error("Error discarding reply", "error", err, "message_id", d.messageID)
 	}
+}
 
-	req, err := http.NewRequest("POST", h.claudeAPIURL, bytes.NewBuffer(reqBody))
+// generateTitle asks the model for a short title summarizing the first exchange
+// and saves it. Failures are ignored and leave the truncated-message title in
+// place; the saved title is returned, or "" if none was generated.
+func (h *ChatHandler) generateTitle(conversationID, userMessage, assistantResponse string) string {
+	truncate := func(text string, n int) string {
+		if len(text) > n {
+			return text[:n]
+		}
+		return text
+	}
+
+	messages := []LLMMessage{{
+		Role:    "user",
+		Content: fmt.Sprintf("User: %s\n\nAssistant: %s", truncate(userMessage, 2000), truncate(assistantResponse, 2000)),
+	}}
+	text, _, err := h.provider.Complete(context.Background(), messages, CompletionOptions{
+		Model:       titleModel,
+		MaxTokens:   30,
+		Temperature: 0.3,
+		System:      "Write a concise 3-6 word title summarizing this conversation. Reply with the title only, without quotes or punctuation at the end.",
+	})
 	if err != nil {
-		return "", err
+		return ""
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", h.claudeAPIKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+	title := strings.Trim(strings.TrimSpace(text), `"'.`)
+	if title == "" || len(title) > 100 {
+		return ""
+	}
 
-	client := &http.Client{Timeout: 120 * time.Second}
-	resp, err := client.Do(req)
+	_, err = h.db.Exec(`UPDATE conversations SET title = $1 WHERE id = $2`, title, conversationID)
 	if err != nil {
-		return "", err
+		return ""
 	}
-	defer resp.Body.Close()
+	return title
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("Claude API error: %s", string(body))
+// streamCompletion relays the provider's text deltas to the client and returns
+// the full text along with the tokens billed and the reason generation stopped.
+// Cancelling ctx, e.g. when the client disconnects, stops the upstream request;
+// the text received so far is still returned alongside the error. Text is
+// saved to draft as it arrives. Until the first text arrives, a keepalive is
+// sent every heartbeatInterval.
+func (h *ChatHandler) streamCompletion(ctx context.Context, sink streamSink, messages []LLMMessage, opts CompletionOptions, draft *replyDraft) (string, Usage, string, error) {
+	// Keepalives start before the provider is called, since it may retry for
+	// a while before returning a stream
+	var heartbeat <-chan time.Time
+	if h.heartbeatInterval > 0 {
+		ticker := time.NewTicker(h.heartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
 	}
 
-	var fullResponse strings.Builder
-	reader := resp.Body
-	buffer := make([]byte, 4096)
+	type streamStart struct {
+		deltas <-chan Delta
+		err    error
+	}
+	started := make(chan streamStart, 1)
+	go func() {
+		deltas, err := h.provider.StreamCompletion(ctx, messages, opts)
+		started <- streamStart{deltas, err}
+	}()
 
+	// deltas stays nil, blocking its case, until the stream has started
+	var deltas <-chan Delta
+	var err error
+	var fullResponse strings.Builder
+	var usage Usage
+	var stopReason string
 	for {
-		n, err := reader.Read(buffer)
-		if n > 0 {
-			chunk := string(buffer[:n])
-			lines := strings.Split(chunk, "\n")
-
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if !strings.HasPrefix(line, "data: ") {
-					continue
-				}
-
-				data := strings.TrimPrefix(line, "data: ")
-				if data == "[DONE]" {
-					break
-				}
-
-				var streamResp map[string]interface{}
-				if err := json.Unmarshal([]byte(data), &streamResp); err != nil {
-					continue
-				}
-
-				if streamResp["type"] == "content_block_delta" {
-					if delta, ok := streamResp["delta"].(map[string]interface{}); ok {
-						if text, ok := delta["text"].(string); ok {
-							fullResponse.WriteString(text)
-							// Send chunk to client
-							fmt.Fprintf(w, "data: %s\n\n", formatStreamEvent("content", text, ""))
-							if f, ok := w.(http.Flusher); ok {
-								f.Flush()
-							}
-						}
-					}
-				}
+		var delta Delta
+		var ok bool
+		select {
+		case start := <-started:
+			if start.err != nil {
+				return "", Usage{}, "", start.err
 			}
+			deltas = start.deltas
+			continue
+		case delta, ok = <-deltas:
+		case <-heartbeat:
+			sink.keepalive()
+			continue
+		}
+		if !ok {
+			break
 		}
 
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fullResponse.String(), err
+		if delta.Text != "" {
+			// Content is flowing, so keepalives are no longer needed
+			heartbeat = nil
+			fullResponse.WriteString(delta.Text)
+			// Send chunk to client
+			sink.send(StreamEvent{Type: "content", Text: delta.Text})
+			draft.flush(fullResponse.String())
+		}
+		if delta.Usage != (Usage{}) {
+			usage = delta.Usage
+		}
+		if delta.StopReason != "" {
+			stopReason = delta.StopReason
+		}
+		if delta.Err != nil {
+			err = delta.Err
 		}
 	}
 
-	return fullResponse.String(), nil
+	return fullResponse.String(), usage, stopReason, err
+}
+
+// cachedResponse looks up a cached assistant response, if caching applies
+func (h *ChatHandler) cachedResponse(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	return h.cache.get(key)
+}
+
+type ModelLimits struct {
+	Model     string `json:"model"`
+	MaxTokens int    `json:"maxTokens"`
+}
+
+// ChatLimits describes server-imposed limits on chat requests. Zero values
+// mean no limit is enforced. MaxConcurrentStreams applies per client IP and
+// MaxConcurrentStreamsTotal across all clients.
+type ChatLimits struct {
+	MaxMessageLength          int           `json:"maxMessageLength"`
+	MaxConcurrentStreams      int           `json:"maxConcurrentStreams"`
+	MaxConcurrentStreamsTotal int           `json:"maxConcurrentStreamsTotal"`
+	Models                    []ModelLimits `json:"models"`
+	Formats                   []string      `json:"formats"`
+}
+
+func (h *ChatHandler) limits() ChatLimits {
+	modelLimits := make([]ModelLimits, len(supportedModels))
+	for i, model := range supportedModels {
+		modelLimits[i] = ModelLimits{Model: model.ID, MaxTokens: maxReplyTokens(model.ID)}
+	}
+
+	return ChatLimits{
+		MaxMessageLength:          h.maxMessageLength,
+		MaxConcurrentStreams:      h.maxStreamsPerIP,
+		MaxConcurrentStreamsTotal: h.maxStreams,
+		Models:                    modelLimits,
+		Formats:                   []string{"sse", "websocket"},
+	}
+}
+
+func (h *ChatHandler) GetLimits(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.limits())
 }
 
 func (h *ChatHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
 	userID := GetUserID(r)
 	if userID == "" {
-		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
 		return
 	}
 
 	conversationID := r.URL.Query().Get("conversationId")
 	if conversationID == "" {
-		http.Error(w, `{"error":"conversationId is required"}`, http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "conversationId is required")
 		return
 	}
 
-	// Verify conversation belongs to user
-	var exists bool
-	err := h.db.QueryRow(
-		`SELECT EXISTS(SELECT 1 FROM conversations WHERE id = $1 AND user_id = $2)`,
-		conversationID, userID,
-	).Scan(&exists)
-
-	if err != nil || !exists {
-		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+	owned, err := h.userOwnsConversation(userID, conversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation", err)
+		return
+	}
+	if !owned {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
 		return
 	}
 
 	messages, err := h.getConversationMessages(conversationID)
 	if err != nil {
-		http.Error(w, `{"error":"Error fetching messages"}`, http.StatusInternalServerError)
+		writeInternalError(w, "Error fetching messages", err)
 		return
 	}
 
@@ -294,39 +830,199 @@ func (h *ChatHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
 func (h *ChatHandler) GetConversations(w http.ResponseWriter, r *http.Request) {
 	userID := GetUserID(r)
 	if userID == "" {
-		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	limit, offset, ok := parsePagination(r, 20, 100)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and 100 and offset must not be negative")
+		return
+	}
+
+	// Archived conversations are hidden unless explicitly requested
+	includeArchived := false
+	if v := r.URL.Query().Get("includeArchived"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "includeArchived must be true or false")
+			return
+		}
+		includeArchived = b
+	}
+
+	// Optionally group into sidebar buckets in the user's timezone
+	groupByDate := r.URL.Query().Get("groupBy") == "date"
+	loc := time.UTC
+	if tz := r.Header.Get("X-Timezone"); groupByDate && tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid timezone")
+			return
+		}
+	}
+
+	// Optionally only list conversations with the given tag
+	tagID := r.URL.Query().Get("tag")
+	const tagFilter = `($3 = '' OR EXISTS (
+		SELECT 1 FROM conversation_tags ct WHERE ct.conversation_id = conversations.id AND ct.tag_id::text = $3
+	))`
+
+	var total int
+	err := h.db.QueryRow(
+		`SELECT COUNT(*) FROM conversations WHERE user_id = $1 AND ($2 OR NOT archived) AND `+tagFilter,
+		userID, includeArchived, tagID,
+	).Scan(&total)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversations", err)
 		return
 	}
 
 	rows, err := h.db.Query(
-		`SELECT id, title, created_at, updated_at FROM conversations 
-		 WHERE user_id = $1 ORDER BY updated_at DESC LIMIT 50`,
-		userID,
+		`SELECT id, title, max_tokens, temperature, system_prompt, archived, pinned, created_at, updated_at FROM conversations 
+		 WHERE user_id = $1 AND ($2 OR NOT archived) AND `+tagFilter+`
+		 ORDER BY pinned DESC, updated_at DESC LIMIT $4 OFFSET $5`,
+		userID, includeArchived, tagID, limit, offset,
 	)
 	if err != nil {
-		http.Error(w, `{"error":"Error fetching conversations"}`, http.StatusInternalServerError)
+		writeInternalError(w, "Error fetching conversations", err)
 		return
 	}
 	defer rows.Close()
 
-	var conversations []models.Conversation
+	conversations := []models.Conversation{}
 	for rows.Next() {
 		var conv models.Conversation
 		conv.UserID = userID
-		err := rows.Scan(&conv.ID, &conv.Title, &conv.CreatedAt, &conv.UpdatedAt)
+		err := rows.Scan(&conv.ID, &conv.Title, &conv.MaxTokens, &conv.Temperature, &conv.SystemPrompt, &conv.Archived, &conv.Pinned, &conv.CreatedAt, &conv.UpdatedAt)
 		if err != nil {
 			continue
 		}
 		conversations = append(conversations, conv)
 	}
 
+	if err := h.loadConversationTags(conversations); err != nil {
+		writeInternalError(w, "Error fetching conversations", err)
+		return
+	}
+
+	hasMore := offset+len(conversations) < total
+
+	if groupByDate {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"groups":  groupConversationsByDate(conversations, time.Now(), loc),
+			"total":   total,
+			"hasMore": hasMore,
+		})
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"conversations": conversations,
+		"total":         total,
+		"hasMore":       hasMore,
 	})
 }
 
-func (h *ChatHandler) createConversation(userID, firstMessage string) (string, error) {
+// parsePagination reads the limit and offset query params, applying
+// defaultLimit when limit is absent. ok is false for invalid values.
+func parsePagination(r *http.Request, defaultLimit, maxLimit int) (limit, offset int, ok bool) {
+	limit = defaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			return 0, 0, false
+		}
+		limit = n
+	}
+
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		offset = n
+	}
+
+	return limit, offset, true
+}
+
+type ConversationGroup struct {
+	Label         string                `json:"label"`
+	Conversations []models.Conversation `json:"conversations"`
+}
+
+// groupConversationsByDate buckets conversations by the calendar day of their
+// updated_at relative to now in loc. Pinned conversations are grouped together
+// ahead of the date buckets. Empty buckets are omitted.
+func groupConversationsByDate(conversations []models.Conversation, now time.Time, loc *time.Location) []ConversationGroup {
+	now = now.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	pinned := ConversationGroup{Label: "Pinned"}
+	buckets := []ConversationGroup{
+		{Label: "Today"},
+		{Label: "Yesterday"},
+		{Label: "Previous 7 Days"},
+		{Label: "Previous 30 Days"},
+		{Label: "Older"},
+	}
+	starts := []time.Time{
+		today,
+		today.AddDate(0, 0, -1),
+		today.AddDate(0, 0, -7),
+		today.AddDate(0, 0, -30),
+		{},
+	}
+
+	for _, conv := range conversations {
+		if conv.Pinned {
+			pinned.Conversations = append(pinned.Conversations, conv)
+			continue
+		}
+		for i, start := range starts {
+			if !conv.UpdatedAt.Before(start) {
+				buckets[i].Conversations = append(buckets[i].Conversations, conv)
+				break
+			}
+		}
+	}
+
+	groups := make([]ConversationGroup, 0, len(buckets)+1)
+	for _, bucket := range append([]ConversationGroup{pinned}, buckets...) {
+		if len(bucket.Conversations) > 0 {
+			groups = append(groups, bucket)
+		}
+	}
+	return groups
+}
+
+// userOwnsConversation reports whether a conversation exists and belongs to
+// the user. IDs that aren't valid UUIDs match no conversation.
+func (h *ChatHandler) userOwnsConversation(userID, conversationID string) (bool, error) {
+	var owned bool
+	err := h.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM conversations WHERE id = $1 AND user_id = $2)`,
+		conversationID, userID,
+	).Scan(&owned)
+
+	if isInvalidID(err) {
+		return false, nil
+	}
+	return owned, err
+}
+
+// isInvalidID reports whether err is Postgres rejecting an ID that isn't a
+// UUID. Routes treat malformed IDs like IDs that don't exist.
+func isInvalidID(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "22P02"
+}
+
+func (h *ChatHandler) createConversation(userID, firstMessage string, settings ConversationSettings) (string, error) {
 	title := firstMessage
 	if len(title) > 50 {
 		title = title[:47] + "..."
@@ -334,17 +1030,51 @@ func (h *ChatHandler) createConversation(userID, firstMessage string) (string, e
 
 	var conversationID string
 	err := h.db.QueryRow(
-		`INSERT INTO conversations (user_id, title) VALUES ($1, $2) RETURNING id`,
-		userID, title,
+		`INSERT INTO conversations (user_id, title, max_tokens, temperature, system_prompt)
+		 VALUES ($1, $2, $3, $4, NULLIF($5, '')) RETURNING id`,
+		userID, title, settings.MaxTokens, settings.Temperature, settings.SystemPrompt,
 	).Scan(&conversationID)
 
 	return conversationID, err
 }
 
+// generationSettings are a conversation's settings with defaults applied
+type generationSettings struct {
+	maxTokens    int
+	temperature  float64
+	systemPrompt string
+}
+
+func (h *ChatHandler) getGenerationSettings(conversationID string) (generationSettings, error) {
+	var maxTokens sql.NullInt64
+	var temperature sql.NullFloat64
+	var systemPrompt sql.NullString
+	err := h.db.QueryRow(
+		`SELECT max_tokens, temperature, system_prompt FROM conversations WHERE id = $1`,
+		conversationID,
+	).Scan(&maxTokens, &temperature, &systemPrompt)
+	if err != nil {
+		return generationSettings{}, err
+	}
+
+	settings := generationSettings{
+		maxTokens:    defaultMaxTokens,
+		temperature:  defaultTemperature,
+		systemPrompt: systemPrompt.String,
+	}
+	if maxTokens.Valid {
+		settings.maxTokens = int(maxTokens.Int64)
+	}
+	if temperature.Valid {
+		settings.temperature = temperature.Float64
+	}
+	return settings, nil
+}
+
 func (h *ChatHandler) getConversationMessages(conversationID string) ([]models.Message, error) {
 	rows, err := h.db.Query(
-		`SELECT id, role, content, created_at FROM messages 
-		 WHERE conversation_id = $1 ORDER BY created_at ASC`,
+		`SELECT id, role, content, COALESCE(model, ''), COALESCE(stop_reason, ''), is_pinned, created_at FROM messages 
+		 WHERE conversation_id = $1 AND deleted_at IS NULL ORDER BY created_at ASC`,
 		conversationID,
 	)
 	if err != nil {
@@ -356,16 +1086,145 @@ func (h *ChatHandler) getConversationMessages(conversationID string) ([]models.M
 	for rows.Next() {
 		var msg models.Message
 		msg.ConversationID = conversationID
-		err := rows.Scan(&msg.ID, &msg.Role, &msg.Content, &msg.CreatedAt)
+		err := rows.Scan(&msg.ID, &msg.Role, &msg.Content, &msg.Model, &msg.StopReason, &msg.IsPinned, &msg.CreatedAt)
 		if err != nil {
 			continue
 		}
 		messages = append(messages, msg)
 	}
 
+	if err := h.loadAttachments(conversationID, messages); err != nil {
+		return nil, err
+	}
 	return messages, nil
 }
 
+// selectContextMessages narrows the history sent to Claude to the given message
+// ids or the last window prior messages. The newest message, which is the turn
+// being sent, is always kept.
+func selectContextMessages(messages []models.Message, ids []string, window int) []models.Message {
+	if len(messages) == 0 || (len(ids) == 0 && window == 0) {
+		return messages
+	}
+
+	prior, current := messages[:len(messages)-1], messages[len(messages)-1]
+
+	var selected []models.Message
+	if len(ids) > 0 {
+		wanted := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			wanted[id] = true
+		}
+		for _, msg := range prior {
+			if wanted[msg.ID] {
+				selected = append(selected, msg)
+			}
+		}
+	} else {
+		if window < len(prior) {
+			prior = prior[len(prior)-window:]
+		}
+		selected = append(selected, prior...)
+	}
+
+	return append(selected, current)
+}
+
+// minContextWindow is assumed for models without a known context window
+const minContextWindow = 200000
+
+// contextWindow returns the context window, in tokens, of a model
+func contextWindow(model string) int {
+	if info, ok := lookupModel(model); ok {
+		return info.ContextWindow
+	}
+	return minContextWindow
+}
+
+// approxTokens estimates the tokens in text at roughly four characters each
+func approxTokens(text string) int {
+	return len(text)/4 + 1
+}
+
+// messageTokens estimates the tokens a message and its images take up
+func messageTokens(msg models.Message) int {
+	return approxTokens(msg.Content) + len(msg.Attachments)*approxImageTokens
+}
+
+// historyBudget is the estimated tokens of history that may be sent with a
+// request: what the model's context window leaves after the system prompt and
+// reply, or the configured budget if that is smaller
+func (h *ChatHandler) historyBudget(opts CompletionOptions) int {
+	budget := contextWindow(opts.Model) - opts.MaxTokens - approxTokens(opts.System)
+	if h.contextBudget > 0 && h.contextBudget < budget {
+		budget = h.contextBudget
+	}
+	return budget
+}
+
+// trimToContextWindow drops the oldest messages until the history's estimated
+// token count fits within budget. The latest message and pinned messages are
+// always kept, and the history is made to start with a user message as the
+// API requires.
+func trimToContextWindow(messages []models.Message, budget int) []models.Message {
+	total := 0
+	for _, msg := range messages {
+		total += messageTokens(msg)
+	}
+	if total <= budget || len(messages) == 0 {
+		return messages
+	}
+
+	prior, current := messages[:len(messages)-1], messages[len(messages)-1]
+
+	var kept []models.Message
+	for _, msg := range prior {
+		if total > budget && !msg.IsPinned {
+			total -= messageTokens(msg)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+
+	for len(kept) > 0 && kept[0].Role != "user" {
+		kept = kept[1:]
+	}
+
+	return append(kept, current)
+}
+
+// alternateRoles makes history acceptable to the API, which requires turns to
+// alternate between user and assistant starting with the user. A failed reply
+// can leave consecutive user messages behind, so messages of the same role are
+// merged, empty ones are dropped, and leading assistant messages are removed.
+func alternateRoles(messages []models.Message) []models.Message {
+	var result []models.Message
+	for _, msg := range messages {
+		if strings.TrimSpace(msg.Content) == "" && len(msg.Attachments) == 0 {
+			continue
+		}
+		if len(result) == 0 && msg.Role != "user" {
+			continue
+		}
+		if last := len(result) - 1; last >= 0 && result[last].Role == msg.Role {
+			merged := result[last]
+			merged.Content = joinContent(merged.Content, msg.Content)
+			merged.Attachments = append(merged.Attachments[:len(merged.Attachments):len(merged.Attachments)], msg.Attachments...)
+			result[last] = merged
+			continue
+		}
+		result = append(result, msg)
+	}
+	return result
+}
+
+func joinContent(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "\n\n" + b
+}
+
 func formatStreamEvent(eventType, text, conversationID string) string {
 	event := StreamEvent{
 		Type:           eventType,
@@ -0,0 +1,604 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/dbtest"
+	"github.com/diyorend/dashGPT-backend/middleware"
+	"github.com/diyorend/dashGPT-backend/models"
+)
+
+// turn returns a message whose content is name padded to ten estimated tokens
+func turn(role, name string) models.Message {
+	return models.Message{ID: name, Role: role, Content: fmt.Sprintf("%-39s", name)}
+}
+
+func pinned(msg models.Message) models.Message {
+	msg.IsPinned = true
+	return msg
+}
+
+// summarize describes messages as role:content pairs, with attachment IDs
+func summarize(messages []models.Message) []string {
+	summary := []string{}
+	for _, msg := range messages {
+		s := msg.Role + ":" + strings.TrimSpace(msg.Content)
+		for _, a := range msg.Attachments {
+			s += "+" + a.ID
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
+
+func TestAlternateRoles(t *testing.T) {
+	image := func(id string) []models.Attachment { return []models.Attachment{{ID: id}} }
+
+	tests := []struct {
+		name     string
+		messages []models.Message
+		want     []string
+	}{
+		{
+			name: "already alternating",
+			messages: []models.Message{
+				{Role: "user", Content: "a"},
+				{Role: "assistant", Content: "b"},
+				{Role: "user", Content: "c"},
+			},
+			want: []string{"user:a", "assistant:b", "user:c"},
+		},
+		{
+			name: "consecutive user messages are merged",
+			messages: []models.Message{
+				{Role: "user", Content: "a"},
+				{Role: "user", Content: "b"},
+				{Role: "assistant", Content: "c"},
+				{Role: "user", Content: "d"},
+			},
+			want: []string{"user:a\n\nb", "assistant:c", "user:d"},
+		},
+		{
+			name: "consecutive assistant messages are merged",
+			messages: []models.Message{
+				{Role: "user", Content: "a"},
+				{Role: "assistant", Content: "b"},
+				{Role: "assistant", Content: "c"},
+				{Role: "user", Content: "d"},
+			},
+			want: []string{"user:a", "assistant:b\n\nc", "user:d"},
+		},
+		{
+			name: "leading assistant messages are dropped",
+			messages: []models.Message{
+				{Role: "assistant", Content: "a"},
+				{Role: "assistant", Content: "b"},
+				{Role: "user", Content: "c"},
+			},
+			want: []string{"user:c"},
+		},
+		{
+			name: "empty messages are dropped before merging",
+			messages: []models.Message{
+				{Role: "user", Content: "a"},
+				{Role: "assistant", Content: "  "},
+				{Role: "user", Content: "b"},
+			},
+			want: []string{"user:a\n\nb"},
+		},
+		{
+			name: "attachments are kept when merging",
+			messages: []models.Message{
+				{Role: "user", Content: "a", Attachments: image("i1")},
+				{Role: "user", Content: "", Attachments: image("i2")},
+			},
+			want: []string{"user:a+i1+i2"},
+		},
+		{
+			name:     "no messages",
+			messages: nil,
+			want:     []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summarize(alternateRoles(tt.messages)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlternateRolesDoesNotModifyInput(t *testing.T) {
+	messages := []models.Message{
+		{Role: "user", Content: "a", Attachments: make([]models.Attachment, 1, 4)},
+		{Role: "user", Content: "b", Attachments: []models.Attachment{{ID: "i2"}}},
+	}
+	alternateRoles(messages)
+
+	// Merging must not append into the spare capacity of the caller's slice
+	if messages[0].Content != "a" || len(messages[0].Attachments) != 1 || messages[0].Attachments[:2][1].ID != "" {
+		t.Errorf("input was modified: %+v", messages[0])
+	}
+}
+
+func TestTrimToContextWindow(t *testing.T) {
+	// Each turn is estimated at ten tokens
+	history := []models.Message{
+		turn("user", "u0"),
+		turn("assistant", "a1"),
+		turn("user", "u2"),
+		turn("assistant", "a3"),
+		turn("user", "u4"),
+	}
+	withPinned := func(i int) []models.Message {
+		messages := append([]models.Message(nil), history...)
+		messages[i] = pinned(messages[i])
+		return messages
+	}
+
+	tests := []struct {
+		name     string
+		messages []models.Message
+		budget   int
+		want     []string
+	}{
+		{
+			name:     "fits",
+			messages: history,
+			budget:   50,
+			want:     []string{"user:u0", "assistant:a1", "user:u2", "assistant:a3", "user:u4"},
+		},
+		{
+			name:     "drops the oldest turns",
+			messages: history,
+			budget:   30,
+			want:     []string{"user:u2", "assistant:a3", "user:u4"},
+		},
+		{
+			name:     "drops an assistant turn left at the start",
+			messages: history,
+			budget:   25,
+			want:     []string{"user:u4"},
+		},
+		{
+			name:     "keeps the latest message over budget",
+			messages: history,
+			budget:   1,
+			want:     []string{"user:u4"},
+		},
+		{
+			name:     "keeps pinned messages",
+			messages: withPinned(0),
+			budget:   30,
+			want:     []string{"user:u0", "assistant:a3", "user:u4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := trimToContextWindow(tt.messages, tt.budget)
+			if s := summarize(got); !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("got %q, want %q", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectContextMessages(t *testing.T) {
+	history := []models.Message{
+		turn("user", "u0"),
+		turn("assistant", "a1"),
+		turn("user", "u2"),
+		turn("assistant", "a3"),
+		turn("user", "u4"),
+	}
+
+	tests := []struct {
+		name   string
+		ids    []string
+		window int
+		want   []string
+	}{
+		{
+			name: "full history by default",
+			want: []string{"user:u0", "assistant:a1", "user:u2", "assistant:a3", "user:u4"},
+		},
+		{
+			name: "ids in history order",
+			ids:  []string{"a3", "u0"},
+			want: []string{"user:u0", "assistant:a3", "user:u4"},
+		},
+		{
+			name: "ids not in the history",
+			ids:  []string{"other-conversation", "a1"},
+			want: []string{"assistant:a1", "user:u4"},
+		},
+		{
+			name: "id of the message being sent",
+			ids:  []string{"u4"},
+			want: []string{"user:u4"},
+		},
+		{
+			name:   "window",
+			window: 2,
+			want:   []string{"user:u2", "assistant:a3", "user:u4"},
+		},
+		{
+			name:   "window of one",
+			window: 1,
+			want:   []string{"assistant:a3", "user:u4"},
+		},
+		{
+			name:   "window larger than the history",
+			window: 10,
+			want:   []string{"user:u0", "assistant:a1", "user:u2", "assistant:a3", "user:u4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectContextMessages(history, tt.ids, tt.window)
+			if s := summarize(got); !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("got %q, want %q", s, tt.want)
+			}
+		})
+	}
+
+	if got := selectContextMessages(nil, []string{"u0"}, 0); len(got) != 0 {
+		t.Errorf("empty history: got %q", summarize(got))
+	}
+}
+
+func TestContextMessageIDsMustBeInTheConversation(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "context@example.com")
+	conversationID := dbtest.CreateConversation(t, db, userID)
+	otherConversationID := dbtest.CreateConversation(t, db, userID)
+	router := chatRouter(newTestChatHandler(db, &FakeProvider{Response: "Hello"}))
+
+	messageIn := func(conversationID string) string {
+		var id string
+		err := db.QueryRow(`SELECT id FROM messages WHERE conversation_id = $1 AND role = 'user'`, conversationID).Scan(&id)
+		if err != nil {
+			t.Fatalf("fetching message: %v", err)
+		}
+		return id
+	}
+
+	tests := []struct {
+		name       string
+		ids        string
+		window     int
+		wantStatus int
+	}{
+		{"message in the conversation", `["` + messageIn(conversationID) + `"]`, 0, http.StatusOK},
+		{"message in another conversation", `["` + messageIn(otherConversationID) + `"]`, 0, http.StatusBadRequest},
+		{"mixed", `["` + messageIn(conversationID) + `","` + messageIn(otherConversationID) + `"]`, 0, http.StatusBadRequest},
+		{"malformed id", `["not-a-uuid"]`, 0, http.StatusBadRequest},
+		{"ids and a window", `["` + messageIn(conversationID) + `"]`, 2, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"message":"Again","conversationId":%q,"contextMessageIds":%s,"contextWindow":%d}`,
+				conversationID, tt.ids, tt.window)
+			w := serveAs(router, userID, http.MethodPost, "/api/chat", body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestTrimmedHistoryAlternatesFromAUserTurn(t *testing.T) {
+	history := []models.Message{
+		pinned(turn("user", "u0")),
+		turn("assistant", "a1"),
+		// A failed reply left two user turns in a row
+		turn("user", "u2"),
+		turn("user", "u3"),
+		turn("assistant", "a4"),
+		turn("user", "u5"),
+	}
+
+	for budget := 1; budget <= 70; budget++ {
+		got := alternateRoles(trimToContextWindow(history, budget))
+		if len(got) == 0 {
+			t.Fatalf("budget %d: empty history", budget)
+		}
+		// The latest message may have been merged into the final user turn
+		if !strings.HasSuffix(strings.TrimSpace(got[len(got)-1].Content), "u5") {
+			t.Errorf("budget %d: latest message was dropped: %q", budget, summarize(got))
+		}
+		for i, msg := range got {
+			if want := [2]string{"user", "assistant"}[i%2]; msg.Role != want {
+				t.Errorf("budget %d: message %d is %s, want %s: %q", budget, i, msg.Role, want, summarize(got))
+				break
+			}
+		}
+	}
+}
+
+// recordingSink records the events and keepalives sent to a client
+type recordingSink struct {
+	events []string
+}
+
+func (s *recordingSink) send(event StreamEvent) error {
+	s.events = append(s.events, event.Type+":"+event.Text)
+	return nil
+}
+
+func (s *recordingSink) keepalive() error {
+	s.events = append(s.events, "keepalive")
+	return nil
+}
+
+func TestStreamCompletionHeartbeat(t *testing.T) {
+	providerErr := errors.New("overloaded")
+
+	tests := []struct {
+		name              string
+		provider          *FakeProvider
+		heartbeatInterval time.Duration
+		wantErr           error
+		wantKeepalives    bool
+	}{
+		{
+			name:              "while the provider retries",
+			provider:          &FakeProvider{Response: "Hello there", Delay: 100 * time.Millisecond},
+			heartbeatInterval: 10 * time.Millisecond,
+			wantKeepalives:    true,
+		},
+		{
+			name:              "before the provider fails",
+			provider:          &FakeProvider{Err: providerErr, Delay: 100 * time.Millisecond},
+			heartbeatInterval: 10 * time.Millisecond,
+			wantErr:           providerErr,
+			wantKeepalives:    true,
+		},
+		{
+			name:              "disabled",
+			provider:          &FakeProvider{Response: "Hello there", Delay: 50 * time.Millisecond},
+			heartbeatInterval: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &ChatHandler{provider: tt.provider, heartbeatInterval: tt.heartbeatInterval}
+			sink := &recordingSink{}
+			draft := &replyDraft{flushedAt: time.Now()}
+
+			text, _, _, err := h.streamCompletion(context.Background(), sink, nil, CompletionOptions{}, draft)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && text != tt.provider.Response {
+				t.Errorf("text = %q, want %q", text, tt.provider.Response)
+			}
+
+			keepalives, content := 0, false
+			for _, event := range sink.events {
+				switch {
+				case event == "keepalive" && content:
+					t.Errorf("keepalive sent after content: %q", sink.events)
+				case event == "keepalive":
+					keepalives++
+				default:
+					content = true
+				}
+			}
+			if (keepalives > 0) != tt.wantKeepalives {
+				t.Errorf("sent %d keepalives before content, want keepalives: %t", keepalives, tt.wantKeepalives)
+			}
+		})
+	}
+}
+
+func TestGroupConversationsByDate(t *testing.T) {
+	newYork := time.FixedZone("EDT", -4*60*60)
+	tokyo := time.FixedZone("JST", 9*60*60)
+	// 06:00 on the 15th in New York and 19:00 in Tokyo
+	now := time.Date(2024, time.March, 15, 10, 0, 0, 0, time.UTC)
+	at := func(day, hour, min, sec int) time.Time {
+		return time.Date(2024, time.March, day, hour, min, sec, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name      string
+		updatedAt time.Time
+		loc       *time.Location
+		want      string
+	}{
+		{"start of today", at(15, 0, 0, 0), time.UTC, "Today"},
+		{"ahead of the clock", at(15, 11, 0, 0), time.UTC, "Today"},
+		{"end of yesterday", at(14, 23, 59, 59), time.UTC, "Yesterday"},
+		{"start of yesterday", at(14, 0, 0, 0), time.UTC, "Yesterday"},
+		{"end of two days ago", at(13, 23, 59, 59), time.UTC, "Previous 7 Days"},
+		{"start of seven days ago", at(8, 0, 0, 0), time.UTC, "Previous 7 Days"},
+		{"end of eight days ago", at(7, 23, 59, 59), time.UTC, "Previous 30 Days"},
+		{"start of thirty days ago", time.Date(2024, time.February, 14, 0, 0, 0, 0, time.UTC), time.UTC, "Previous 30 Days"},
+		{"end of thirty-one days ago", time.Date(2024, time.February, 13, 23, 59, 59, 0, time.UTC), time.UTC, "Older"},
+
+		// 22:00 on the 14th in New York, but already the 15th in UTC
+		{"before midnight in New York", at(15, 2, 0, 0), time.UTC, "Today"},
+		{"before midnight in New York", at(15, 2, 0, 0), newYork, "Yesterday"},
+		// 01:00 on the 15th in Tokyo, but still the 14th in UTC
+		{"after midnight in Tokyo", at(14, 16, 0, 0), time.UTC, "Yesterday"},
+		{"after midnight in Tokyo", at(14, 16, 0, 0), tokyo, "Today"},
+		// Days start at local midnight, not at midnight UTC
+		{"start of today in Tokyo", at(14, 15, 0, 0), tokyo, "Today"},
+		{"end of yesterday in Tokyo", at(14, 14, 59, 59), tokyo, "Yesterday"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" in "+tt.loc.String(), func(t *testing.T) {
+			groups := groupConversationsByDate([]models.Conversation{{ID: "c", UpdatedAt: tt.updatedAt}}, now, tt.loc)
+			if len(groups) != 1 || groups[0].Label != tt.want {
+				t.Errorf("groups = %+v, want only %s", groups, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupConversationsByDateOrder(t *testing.T) {
+	now := time.Date(2024, time.March, 15, 10, 0, 0, 0, time.UTC)
+	conversations := []models.Conversation{
+		{ID: "pinned-old", Pinned: true, UpdatedAt: now.AddDate(-1, 0, 0)},
+		{ID: "today", UpdatedAt: now},
+		{ID: "old", UpdatedAt: now.AddDate(-1, 0, 0)},
+		{ID: "yesterday", UpdatedAt: now.AddDate(0, 0, -1)},
+	}
+
+	var got []string
+	for _, group := range groupConversationsByDate(conversations, now, time.UTC) {
+		for _, conv := range group.Conversations {
+			got = append(got, group.Label+":"+conv.ID)
+		}
+	}
+	// Pinned first, then newest first, with empty buckets omitted
+	want := []string{"Pinned:pinned-old", "Today:today", "Yesterday:yesterday", "Older:old"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groups = %q, want %q", got, want)
+	}
+}
+
+func TestGetConversationsInvalidTimezone(t *testing.T) {
+	// The timezone is rejected before the database is queried
+	h := newTestChatHandler(nil, &FakeProvider{})
+	r := httptest.NewRequest(http.MethodGet, "/api/chat/conversations?groupBy=date", nil)
+	r.Header.Set("X-Timezone", "Mars/Olympus_Mons")
+	r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, "user"))
+	w := httptest.NewRecorder()
+	h.GetConversations(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "Invalid timezone") {
+		t.Errorf("body = %s, want an invalid timezone error", w.Body)
+	}
+}
+
+func TestSystemPromptOverrideLength(t *testing.T) {
+	// Rejected before the database is queried
+	h := newTestChatHandler(nil, &FakeProvider{})
+	req := ChatRequest{Message: "Hi", SystemPromptOverride: strings.Repeat("a", maxSystemPromptLength+1)}
+	_, chatErr := h.prepareReply(context.Background(), "user", req)
+	if chatErr == nil || chatErr.status != http.StatusBadRequest {
+		t.Fatalf("error = %+v, want a bad request", chatErr)
+	}
+}
+
+func TestSystemPromptOverride(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "override@example.com")
+	provider := &FakeProvider{Response: "Hello"}
+	router := chatRouter(newTestChatHandler(db, provider))
+
+	w := serveAs(router, userID, http.MethodPost, "/api/chat", `{"message":"Hi","systemPrompt":"Stored prompt"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusOK, w.Body)
+	}
+	conversationID := parseSSE(t, w.Body.String())[0].ConversationID
+
+	body := `{"message":"Again","conversationId":"` + conversationID + `","systemPromptOverride":"Override prompt"}`
+	w = serveAs(router, userID, http.MethodPost, "/api/chat", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var systems []string
+	for _, opts := range provider.Streamed() {
+		systems = append(systems, opts.System)
+	}
+	if want := []string{"Stored prompt", "Override prompt"}; !reflect.DeepEqual(systems, want) {
+		t.Errorf("system prompts sent = %q, want %q", systems, want)
+	}
+
+	var stored string
+	if err := db.QueryRow(`SELECT system_prompt FROM conversations WHERE id = $1`, conversationID).Scan(&stored); err != nil {
+		t.Fatalf("fetching conversation: %v", err)
+	}
+	if stored != "Stored prompt" {
+		t.Errorf("stored system prompt = %q, want it unchanged", stored)
+	}
+}
+
+func TestCancelledStreamSavesPartialReply(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "cancel@example.com")
+	conversationID := dbtest.CreateConversation(t, db, userID)
+
+	upstream, upstreamCancelled := newStalledClaudeServer(t, "Partial ", "reply")
+	router := chatRouter(newTestChatHandler(db, newTestClaudeProvider(upstream.URL, time.Minute)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, userID)))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := `{"message":"Hi","conversationId":"` + conversationID + `"}`
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/chat", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("sending message: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Disconnect once the partial reply has been streamed
+	var streamed strings.Builder
+	buf := make([]byte, 512)
+	for !strings.Contains(streamed.String(), "reply") {
+		n, err := resp.Body.Read(buf)
+		streamed.Write(buf[:n])
+		if err != nil {
+			t.Fatalf("stream ended before the partial reply: %v; body: %s", err, streamed.String())
+		}
+	}
+	cancel()
+
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+
+	// The handler saves the draft after the upstream request ends
+	var content string
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		err := db.QueryRow(
+			`SELECT content FROM messages
+			 WHERE conversation_id = $1 AND role = 'assistant' AND deleted_at IS NULL
+			 ORDER BY created_at DESC LIMIT 1`,
+			conversationID,
+		).Scan(&content)
+		if err != nil && err != sql.ErrNoRows {
+			t.Fatalf("fetching reply: %v", err)
+		}
+		if content == "Partial reply" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if content != "Partial reply" {
+		t.Errorf("saved reply = %q, want %q", content, "Partial reply")
+	}
+}
@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/metrics"
+)
+
+type ClaudeMessage struct {
+	Role    string               `json:"role"`
+	Content []ClaudeContentBlock `json:"content"`
+}
+
+// ClaudeContentBlock is a text or image part of a message
+type ClaudeContentBlock struct {
+	Type   string             `json:"type"`
+	Text   string             `json:"text,omitempty"`
+	Source *ClaudeImageSource `json:"source,omitempty"`
+}
+
+type ClaudeImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type ClaudeRequest struct {
+	Model       string          `json:"model"`
+	MaxTokens   int             `json:"max_tokens"`
+	System      string          `json:"system,omitempty"`
+	Messages    []ClaudeMessage `json:"messages"`
+	Stream      bool            `json:"stream"`
+	Temperature float64         `json:"temperature"`
+}
+
+type ClaudeResponse struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Role    string `json:"role"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Model      string `json:"model"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// Text concatenates the text content blocks of the response
+func (r *ClaudeResponse) Text() string {
+	var text strings.Builder
+	for _, block := range r.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return text.String()
+}
+
+const (
+	maxClaudeRetries   = 3
+	claudeRetryBackoff = time.Second
+	maxClaudeRetryWait = 30 * time.Second
+
+	// maxSSELineSize bounds a single line of the Claude event stream
+	maxSSELineSize = 1 << 20 // 1MB
+	// maxClaudeResponseSize bounds how much of a non-streaming response is read
+	maxClaudeResponseSize = 10 << 20 // 10MB
+	// maxClaudeErrorBodySize bounds how much of an error response is read
+	maxClaudeErrorBodySize = 64 << 10 // 64KB
+)
+
+// ClaudeProvider is an LLMProvider backed by the Anthropic messages API
+type ClaudeProvider struct {
+	apiKey string
+	apiURL string
+	client *http.Client
+}
+
+// NewClaudeProvider creates a provider whose requests, including reading a
+// streamed response, must complete within timeout
+func NewClaudeProvider(apiKey string, timeout time.Duration) *ClaudeProvider {
+	return &ClaudeProvider{
+		apiKey: apiKey,
+		apiURL: "https://api.anthropic.com/v1/messages",
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func newClaudeRequest(messages []LLMMessage, opts CompletionOptions, stream bool) ClaudeRequest {
+	claudeMessages := make([]ClaudeMessage, len(messages))
+	for i, msg := range messages {
+		// Images go before the text that refers to them
+		var content []ClaudeContentBlock
+		for _, image := range msg.Images {
+			content = append(content, ClaudeContentBlock{
+				Type: "image",
+				Source: &ClaudeImageSource{
+					Type:      "base64",
+					MediaType: image.MediaType,
+					Data:      base64.StdEncoding.EncodeToString(image.Data),
+				},
+			})
+		}
+		if msg.Content != "" || len(content) == 0 {
+			content = append(content, ClaudeContentBlock{Type: "text", Text: msg.Content})
+		}
+
+		claudeMessages[i] = ClaudeMessage{
+			Role:    msg.Role,
+			Content: content,
+		}
+	}
+
+	return ClaudeRequest{
+		Model:       opts.Model,
+		MaxTokens:   opts.MaxTokens,
+		System:      opts.System,
+		Messages:    claudeMessages,
+		Stream:      stream,
+		Temperature: opts.Temperature,
+	}
+}
+
+// StreamCompletion relays Claude's text deltas. Cancelling ctx, e.g. when the
+// client disconnects, stops the upstream request.
+func (p *ClaudeProvider) StreamCompletion(ctx context.Context, messages []LLMMessage, opts CompletionOptions) (<-chan Delta, error) {
+	start := time.Now()
+	resp, err := p.sendRequest(ctx, newClaudeRequest(messages, opts, true))
+	if err != nil {
+		observeClaudeRequest(ctx, opts.Model, true, start, err)
+		return nil, err
+	}
+
+	deltas := make(chan Delta)
+	go func() {
+		defer close(deltas)
+		defer resp.Body.Close()
+
+		usage, stopReason, err := readClaudeStream(ctx, resp.Body, deltas)
+		observeClaudeRequest(ctx, opts.Model, true, start, err)
+		deltas <- Delta{Usage: usage, StopReason: stopReason, Err: err}
+	}()
+	return deltas, nil
+}
+
+// observeClaudeRequest records a request's duration and, unless the caller
+// cancelled it, whether it failed
+func observeClaudeRequest(ctx context.Context, model string, stream bool, start time.Time, err error) {
+	metrics.ClaudeRequestDuration.WithLabelValues(model, strconv.FormatBool(stream)).Observe(time.Since(start).Seconds())
+	if err != nil && ctx.Err() == nil {
+		metrics.ClaudeErrors.WithLabelValues(model).Inc()
+	}
+}
+
+// readClaudeStream parses Claude's event stream, sending text to deltas and
+// returning the tokens billed and the reason generation stopped. A stream that
+// reports an error or ends before message_stop is returned as an error, so a
+// partial reply is never mistaken for a complete one.
+func readClaudeStream(ctx context.Context, body io.Reader, deltas chan<- Delta) (Usage, string, error) {
+	var usage Usage
+	var stopReason string
+
+	// Scan line by line so data lines split across reads are reassembled
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxSSELineSize)
+
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return usage, stopReason, err
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			return usage, stopReason, nil
+		}
+
+		var streamResp map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &streamResp); err != nil {
+			continue
+		}
+
+		switch streamResp["type"] {
+		case "message_start":
+			if message, ok := streamResp["message"].(map[string]interface{}); ok {
+				if u, ok := message["usage"].(map[string]interface{}); ok {
+					if n, ok := u["input_tokens"].(float64); ok {
+						usage.InputTokens = int(n)
+					}
+				}
+			}
+		case "message_delta":
+			if u, ok := streamResp["usage"].(map[string]interface{}); ok {
+				if n, ok := u["output_tokens"].(float64); ok {
+					usage.OutputTokens = int(n)
+				}
+			}
+			if delta, ok := streamResp["delta"].(map[string]interface{}); ok {
+				if reason, ok := delta["stop_reason"].(string); ok {
+					stopReason = reason
+				}
+			}
+		case "message_stop":
+			return usage, stopReason, nil
+		case "error":
+			streamErr := &claudeStreamError{}
+			if e, ok := streamResp["error"].(map[string]interface{}); ok {
+				streamErr.Type, _ = e["type"].(string)
+				streamErr.Message, _ = e["message"].(string)
+			}
+			return usage, stopReason, streamErr
+		case "content_block_delta":
+			if delta, ok := streamResp["delta"].(map[string]interface{}); ok {
+				if text, ok := delta["text"].(string); ok {
+					deltas <- Delta{Text: text}
+				}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() == nil && isTimeout(err) {
+			return usage, stopReason, &claudeTimeoutError{Phase: "read", Err: err}
+		}
+		return usage, stopReason, err
+	}
+	return usage, stopReason, fmt.Errorf("Claude stream ended before message_stop: %w", io.ErrUnexpectedEOF)
+}
+
+// Complete sends a non-streaming request and returns the response text
+func (p *ClaudeProvider) Complete(ctx context.Context, messages []LLMMessage, opts CompletionOptions) (text string, usage Usage, err error) {
+	start := time.Now()
+	defer func() { observeClaudeRequest(ctx, opts.Model, false, start, err) }()
+
+	resp, err := p.doRequest(ctx, newClaudeRequest(messages, opts, false))
+	if err != nil {
+		return "", Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", Usage{}, readClaudeAPIError(resp)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxClaudeResponseSize+1))
+	if err != nil {
+		if ctx.Err() == nil && isTimeout(err) {
+			return "", Usage{}, &claudeTimeoutError{Phase: "read", Err: err}
+		}
+		return "", Usage{}, fmt.Errorf("reading Claude response (status %d): %w", resp.StatusCode, err)
+	}
+
+	claudeResp, err := parseClaudeResponse(resp.StatusCode, body)
+	if err != nil {
+		return "", Usage{}, err
+	}
+
+	usage = Usage{
+		InputTokens:  claudeResp.Usage.InputTokens,
+		OutputTokens: claudeResp.Usage.OutputTokens,
+	}
+	return claudeResp.Text(), usage, nil
+}
+
+// parseClaudeResponse decodes a non-streaming response body, rejecting bodies
+// that are empty, oversized, truncated or contain no text, so a blank reply is
+// never mistaken for a successful one
+func parseClaudeResponse(status int, body []byte) (*ClaudeResponse, error) {
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty Claude response (status %d)", status)
+	}
+	if len(body) > maxClaudeResponseSize {
+		return nil, fmt.Errorf("Claude response exceeds %d bytes (status %d)", maxClaudeResponseSize, status)
+	}
+
+	var claudeResp ClaudeResponse
+	if err := json.Unmarshal(body, &claudeResp); err != nil {
+		return nil, fmt.Errorf("malformed Claude response (status %d): %w", status, err)
+	}
+
+	if strings.TrimSpace(claudeResp.Text()) == "" {
+		return nil, fmt.Errorf("Claude response contained no text (status %d)", status)
+	}
+
+	return &claudeResp, nil
+}
+
+// doRequest sends a request to the Claude messages API
+func (p *ClaudeProvider) doRequest(ctx context.Context, claudeReq ClaudeRequest) (*http.Response, error) {
+	reqBody, err := json.Marshal(claudeReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.apiURL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := p.client.Do(req)
+	if err != nil && ctx.Err() == nil && isTimeout(err) {
+		phase := "read"
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			phase = "connect"
+		}
+		return nil, &claudeTimeoutError{Phase: phase, Err: err}
+	}
+	return resp, err
+}
+
+// sendRequest sends a request, retrying rate limits, server errors and
+// network failures with exponential backoff. Retries only happen before a
+// response is accepted, so no streamed content is ever duplicated.
+func (p *ClaudeProvider) sendRequest(ctx context.Context, claudeReq ClaudeRequest) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := p.doRequest(ctx, claudeReq)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		retryable := ctx.Err() == nil
+		wait := claudeRetryBackoff << attempt
+		if err == nil {
+			apiErr := readClaudeAPIError(resp)
+			retryable = retryable && apiErr.retryable()
+			if seconds, convErr := strconv.Atoi(resp.Header.Get("retry-after")); convErr == nil && seconds >= 0 {
+				wait = time.Duration(seconds) * time.Second
+			}
+			err = apiErr
+		}
+
+		if !retryable || attempt == maxClaudeRetries {
+			return nil, err
+		}
+		if wait > maxClaudeRetryWait {
+			wait = maxClaudeRetryWait
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// claudeAPIError is a non-200 response from the Claude API
+type claudeAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *claudeAPIError) Error() string {
+	return fmt.Sprintf("Claude API error (status %d): %s", e.StatusCode, e.Body)
+}
+
+// readClaudeAPIError reads and closes the body of a non-200 response. Only the
+// start of the body is kept, since it is only used for logging.
+func readClaudeAPIError(resp *http.Response) *claudeAPIError {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxClaudeErrorBodySize))
+	return &claudeAPIError{StatusCode: resp.StatusCode, Body: string(body)}
+}
+
+// retryable reports whether the request may succeed if sent again
+func (e *claudeAPIError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// claudeStreamError is an error event sent by Claude after streaming started,
+// e.g. when the API becomes overloaded mid-response
+type claudeStreamError struct {
+	Type    string
+	Message string
+}
+
+func (e *claudeStreamError) Error() string {
+	return fmt.Sprintf("Claude stream error (%s): %s", e.Type, e.Message)
+}
+
+// claudeTimeoutError is a request to Claude that timed out while connecting or
+// while waiting for or reading the response
+type claudeTimeoutError struct {
+	Phase string // "connect" or "read"
+	Err   error
+}
+
+func (e *claudeTimeoutError) Error() string {
+	return fmt.Sprintf("Claude %s timeout: %v", e.Phase, e.Err)
+}
+
+func (e *claudeTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// isTimeout reports whether err is a network or client timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// userFacingError converts a completion failure into a message that is safe
+// to show to clients without leaking API details
+func userFacingError(err error) string {
+	var apiErr *claudeAPIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			return "Claude is receiving too many requests right now. Please try again shortly."
+		case apiErr.StatusCode >= 500:
+			return "Claude is temporarily unavailable. Please try again."
+		default:
+			return "The request to Claude could not be completed."
+		}
+	}
+	var streamErr *claudeStreamError
+	if errors.As(err, &streamErr) {
+		switch streamErr.Type {
+		case "rate_limit_error":
+			return "Claude is receiving too many requests right now. Please try again shortly."
+		case "overloaded_error", "api_error":
+			return "Claude is temporarily unavailable. Please try again."
+		default:
+			return "The request to Claude could not be completed."
+		}
+	}
+	var timeoutErr *claudeTimeoutError
+	if errors.As(err, &timeoutErr) {
+		if timeoutErr.Phase == "connect" {
+			return "Timed out connecting to Claude. Please try again."
+		}
+		return "Claude took too long to respond. Please try again."
+	}
+	return "Could not reach Claude. Please try again."
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// sseEvent formats a Claude stream event as it arrives over the wire
+func sseEvent(eventType, data string) string {
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, data)
+}
+
+// chunkedReader returns at most n bytes per read, splitting lines and events
+// across reads the way a network connection may
+type chunkedReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+// runClaudeStream parses body, collecting the text sent to deltas
+func runClaudeStream(t *testing.T, body io.Reader) (string, Usage, string, error) {
+	t.Helper()
+
+	deltas := make(chan Delta)
+	var text strings.Builder
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for d := range deltas {
+			text.WriteString(d.Text)
+		}
+	}()
+
+	usage, stopReason, err := readClaudeStream(context.Background(), body, deltas)
+	close(deltas)
+	<-done
+	return text.String(), usage, stopReason, err
+}
+
+func TestReadClaudeStream(t *testing.T) {
+	complete := sseEvent("message_start", `{"type":"message_start","message":{"usage":{"input_tokens":12}}}`) +
+		sseEvent("content_block_start", `{"type":"content_block_start","index":0}`) +
+		sseEvent("content_block_delta", `{"type":"content_block_delta","delta":{"type":"text_delta","text":"Hello"}}`) +
+		sseEvent("ping", `{"type":"ping"}`) +
+		sseEvent("content_block_delta", `{"type":"content_block_delta","delta":{"type":"text_delta","text":", world"}}`) +
+		sseEvent("message_delta", `{"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":7}}`) +
+		sseEvent("message_stop", `{"type":"message_stop"}`)
+
+	long := strings.Repeat("x", 200<<10) // longer than bufio.Scanner's 64KB default
+	longLine := sseEvent("content_block_delta", `{"type":"content_block_delta","delta":{"type":"text_delta","text":"`+long+`"}}`) +
+		sseEvent("message_stop", `{"type":"message_stop"}`)
+
+	tests := []struct {
+		name           string
+		body           io.Reader
+		wantText       string
+		wantUsage      Usage
+		wantStopReason string
+		wantErr        func(error) bool
+	}{
+		{
+			name:           "whole stream",
+			body:           strings.NewReader(complete),
+			wantText:       "Hello, world",
+			wantUsage:      Usage{InputTokens: 12, OutputTokens: 7},
+			wantStopReason: "max_tokens",
+		},
+		{
+			name:           "one byte per read",
+			body:           iotest.OneByteReader(strings.NewReader(complete)),
+			wantText:       "Hello, world",
+			wantUsage:      Usage{InputTokens: 12, OutputTokens: 7},
+			wantStopReason: "max_tokens",
+		},
+		{
+			name:           "events split mid-line",
+			body:           &chunkedReader{r: strings.NewReader(complete), n: 7},
+			wantText:       "Hello, world",
+			wantUsage:      Usage{InputTokens: 12, OutputTokens: 7},
+			wantStopReason: "max_tokens",
+		},
+		{
+			name:     "line longer than the default scanner buffer",
+			body:     &chunkedReader{r: strings.NewReader(longLine), n: 4096},
+			wantText: long,
+		},
+		{
+			name: "line longer than the maximum",
+			body: strings.NewReader(sseEvent("content_block_delta", strings.Repeat("x", maxSSELineSize+1))),
+			wantErr: func(err error) bool {
+				return errors.Is(err, bufio.ErrTooLong)
+			},
+		},
+		{
+			name: "error event",
+			body: strings.NewReader(
+				sseEvent("content_block_delta", `{"type":"content_block_delta","delta":{"type":"text_delta","text":"Partial"}}`) +
+					sseEvent("error", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`),
+			),
+			wantText: "Partial",
+			wantErr: func(err error) bool {
+				var streamErr *claudeStreamError
+				return errors.As(err, &streamErr) && streamErr.Type == "overloaded_error" && streamErr.Message == "Overloaded"
+			},
+		},
+		{
+			name:     "ends before message_stop",
+			body:     strings.NewReader(sseEvent("content_block_delta", `{"type":"content_block_delta","delta":{"type":"text_delta","text":"Cut"}}`)),
+			wantText: "Cut",
+			wantErr: func(err error) bool {
+				return errors.Is(err, io.ErrUnexpectedEOF)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, usage, stopReason, err := runClaudeStream(t, tt.body)
+
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != nil && !tt.wantErr(err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if text != tt.wantText {
+				t.Errorf("text = %.40q (%d bytes), want %.40q (%d bytes)", text, len(text), tt.wantText, len(tt.wantText))
+			}
+			if usage != tt.wantUsage {
+				t.Errorf("usage = %+v, want %+v", usage, tt.wantUsage)
+			}
+			if stopReason != tt.wantStopReason {
+				t.Errorf("stop reason = %q, want %q", stopReason, tt.wantStopReason)
+			}
+		})
+	}
+}
+
+func TestParseClaudeResponse(t *testing.T) {
+	const valid = `{"id":"msg_1","type":"message","role":"assistant",` +
+		`"content":[{"type":"text","text":"Hello"},{"type":"text","text":" there"}],` +
+		`"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":2}}`
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string // substring of the error, or "" for success
+	}{
+		{"valid", valid, ""},
+		{"empty", "", "empty Claude response (status 200)"},
+		{"oversized", `{"content":[{"type":"text","text":"` + strings.Repeat("a", maxClaudeResponseSize) + `"}]}`, fmt.Sprintf("exceeds %d bytes", maxClaudeResponseSize)},
+		{"truncated", valid[:len(valid)/2], "malformed Claude response (status 200)"},
+		{"not JSON", "<html>Bad Gateway</html>", "malformed Claude response"},
+		{"wrong shape", `{"content":"Hello"}`, "malformed Claude response"},
+		{"no content blocks", `{"content":[],"stop_reason":"end_turn"}`, "contained no text"},
+		{"no text block", `{"content":[{"type":"tool_use","id":"toolu_1","name":"lookup","input":{}}]}`, "contained no text"},
+		{"blank text", `{"content":[{"type":"text","text":" \n "}]}`, "contained no text"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := parseClaudeResponse(200, []byte(tt.body))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if resp.Text() != "Hello there" || resp.Usage.OutputTokens != 2 {
+					t.Errorf("response = %+v, want the decoded message", resp)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if resp != nil {
+				t.Errorf("response = %+v, want none with an error", resp)
+			}
+		})
+	}
+
+	// Decoding errors are kept for logging
+	_, err := parseClaudeResponse(200, []byte(valid[:len(valid)/2]))
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Errorf("truncated body error = %v, want it to wrap a JSON syntax error", err)
+	}
+}
+
+// newTestClaudeProvider returns a provider sending requests to url
+func newTestClaudeProvider(url string, timeout time.Duration) *ClaudeProvider {
+	p := NewClaudeProvider("test-key", timeout)
+	p.apiURL = url
+	return p
+}
+
+// newStalledClaudeServer streams text as a reply, then holds the response open
+// without finishing it. cancelled is closed once the request is cancelled.
+func newStalledClaudeServer(t *testing.T, text ...string) (srv *httptest.Server, cancelled <-chan struct{}) {
+	t.Helper()
+
+	done := make(chan struct{})
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, sseEvent("message_start", `{"type":"message_start","message":{"usage":{"input_tokens":5}}}`))
+		for _, s := range text {
+			data, _ := json.Marshal(map[string]interface{}{
+				"type":  "content_block_delta",
+				"delta": map[string]string{"type": "text_delta", "text": s},
+			})
+			fmt.Fprint(w, sseEvent("content_block_delta", string(data)))
+		}
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+			close(done)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, done
+}
+
+func TestClaudeStreamCancelled(t *testing.T) {
+	srv, upstreamCancelled := newStalledClaudeServer(t, "Partial ", "reply")
+	provider := newTestClaudeProvider(srv.URL, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deltas, err := provider.StreamCompletion(ctx, []LLMMessage{{Role: "user", Content: "Hi"}}, CompletionOptions{Model: defaultModel, MaxTokens: 100})
+	if err != nil {
+		t.Fatalf("starting stream: %v", err)
+	}
+
+	var text string
+	for text != "Partial reply" {
+		d, ok := <-deltas
+		if !ok || d.Err != nil {
+			t.Fatalf("stream ended early with %q: %v", text, d.Err)
+		}
+		text += d.Text
+	}
+	cancel()
+
+	var last Delta
+	for d := range deltas {
+		last = d
+	}
+	if !errors.Is(last.Err, context.Canceled) {
+		t.Errorf("final error = %v, want context.Canceled", last.Err)
+	}
+
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+}
+
+func TestClaudeTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	messages := []LLMMessage{{Role: "user", Content: "Hi"}}
+	opts := CompletionOptions{Model: defaultModel, MaxTokens: 100}
+
+	t.Run("waiting for the response", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Read the request so the server notices the client giving up
+			io.Copy(io.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+		}))
+		t.Cleanup(srv.Close)
+
+		_, _, err := newTestClaudeProvider(srv.URL, timeout).Complete(context.Background(), messages, opts)
+		checkClaudeTimeout(t, err)
+	})
+
+	t.Run("reading the stream", func(t *testing.T) {
+		srv, _ := newStalledClaudeServer(t, "Partial")
+		deltas, err := newTestClaudeProvider(srv.URL, timeout).StreamCompletion(context.Background(), messages, opts)
+		if err != nil {
+			t.Fatalf("starting stream: %v", err)
+		}
+		var last Delta
+		for d := range deltas {
+			last = d
+		}
+		checkClaudeTimeout(t, last.Err)
+	})
+}
+
+// checkClaudeTimeout checks err is a read timeout shown to users as one
+func checkClaudeTimeout(t *testing.T, err error) {
+	t.Helper()
+
+	var timeoutErr *claudeTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("error = %v, want a timeout", err)
+	}
+	if timeoutErr.Phase != "read" {
+		t.Errorf("phase = %q, want read", timeoutErr.Phase)
+	}
+	if got, want := userFacingError(err), "Claude took too long to respond. Please try again."; got != want {
+		t.Errorf("userFacingError = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// CleanupEmptyConversations periodically deletes conversations left without a
+// reply, such as when the model call failed after the conversation was
+// created, until ctx is cancelled. Only conversations with no assistant
+// messages and no activity for maxAge are deleted; replies being streamed
+// already have an assistant message, so active conversations are not touched.
+// Pinned conversations are kept.
+func (h *ChatHandler) CleanupEmptyConversations(ctx context.Context, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := h.deleteEmptyConversations(ctx, maxAge)
+		if err != nil {
+			slog.Error("Error cleaning up empty conversations", "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("Cleaned up empty conversations", "count", n)
+		}
+	}
+}
+
+func (h *ChatHandler) deleteEmptyConversations(ctx context.Context, maxAge time.Duration) (int64, error) {
+	result, err := h.db.ExecContext(ctx,
+		`DELETE FROM conversations c
+		 WHERE NOT c.pinned
+		   AND c.updated_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+		   AND NOT EXISTS (
+			SELECT 1 FROM messages m
+			WHERE m.conversation_id = c.id AND m.deleted_at IS NULL
+			  AND (m.role = 'assistant' OR m.created_at >= CURRENT_TIMESTAMP - $1 * INTERVAL '1 second')
+		   )`,
+		int(maxAge.Seconds()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DeleteConversation deletes a conversation owned by the user. Its messages,
+// including soft-deleted ones, are removed by the ON DELETE CASCADE foreign key.
+func (h *ChatHandler) DeleteConversation(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	conversationID := chi.URLParam(r, "id")
+
+	result, err := h.db.Exec(
+		`DELETE FROM conversations WHERE id = $1 AND user_id = $2`,
+		conversationID, userID,
+	)
+	if isInvalidID(err) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error deleting conversation", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteConversations clears the user's conversation history, or with the
+// olderThan query param (e.g. 90d or 12h) only conversations last updated
+// before then. A single statement deletes them and their messages atomically.
+func (h *ChatHandler) DeleteConversations(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	query := `DELETE FROM conversations WHERE user_id = $1`
+	args := []interface{}{userID}
+	if v := r.URL.Query().Get("olderThan"); v != "" {
+		age, err := parseAge(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "olderThan must be a positive age such as 90d or 12h")
+			return
+		}
+		query += ` AND updated_at < CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'`
+		args = append(args, int64(age.Seconds()))
+	}
+
+	result, err := h.db.Exec(query, args...)
+	if err != nil {
+		writeInternalError(w, "Error deleting conversations", err)
+		return
+	}
+	deleted, _ := result.RowsAffected()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deleted": deleted,
+	})
+}
+
+// parseAge parses a positive age given in days (e.g. 90d) or as a duration
+// (e.g. 12h)
+func parseAge(v string) (time.Duration, error) {
+	var age time.Duration
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, err
+		}
+		age = d
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("age must be positive")
+	}
+	return age, nil
+}
+
+// RenameConversationRequest updates the title and/or system prompt. An empty
+// system prompt clears it.
+type RenameConversationRequest struct {
+	Title        *string `json:"title,omitempty"`
+	SystemPrompt *string `json:"systemPrompt,omitempty"`
+}
+
+// maxTitleLength matches the conversations.title column size
+const maxTitleLength = 500
+
+func (h *ChatHandler) RenameConversation(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	conversationID := chi.URLParam(r, "id")
+
+	var req RenameConversationRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.Title == nil && req.SystemPrompt == nil {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Title or systemPrompt is required")
+		return
+	}
+
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Title must not be empty")
+			return
+		}
+		if utf8.RuneCountInString(title) > maxTitleLength {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Title must be at most 500 characters")
+			return
+		}
+		req.Title = &title
+	}
+
+	if msg := (ConversationSettings{SystemPrompt: req.SystemPrompt}).validate(); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, msg)
+		return
+	}
+
+	var conv models.Conversation
+	err := h.db.QueryRow(
+		`UPDATE conversations SET
+			title = COALESCE($1, title),
+			system_prompt = CASE WHEN $2::text IS NULL THEN system_prompt ELSE NULLIF($2, '') END,
+			updated_at = CURRENT_TIMESTAMP
+		 WHERE id = $3 AND user_id = $4
+		 RETURNING id, user_id, title, max_tokens, temperature, system_prompt, archived, pinned, created_at, updated_at`,
+		req.Title, req.SystemPrompt, conversationID, userID,
+	).Scan(&conv.ID, &conv.UserID, &conv.Title, &conv.MaxTokens, &conv.Temperature, &conv.SystemPrompt, &conv.Archived, &conv.Pinned, &conv.CreatedAt, &conv.UpdatedAt)
+
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error updating conversation", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conv)
+}
+
+// ArchiveConversation toggles whether a conversation is archived. Archived
+// conversations are kept but hidden from the conversation list by default.
+func (h *ChatHandler) ArchiveConversation(w http.ResponseWriter, r *http.Request) {
+	h.toggleConversationFlag(w, r, "archived")
+}
+
+// PinConversation toggles whether a conversation is pinned to the top of the
+// conversation list
+func (h *ChatHandler) PinConversation(w http.ResponseWriter, r *http.Request) {
+	h.toggleConversationFlag(w, r, "pinned")
+}
+
+// toggleConversationFlag flips a boolean column on a conversation owned by the
+// user. column must be a constant, never user input.
+func (h *ChatHandler) toggleConversationFlag(w http.ResponseWriter, r *http.Request, column string) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	conversationID := chi.URLParam(r, "id")
+
+	var conv models.Conversation
+	err := h.db.QueryRow(
+		fmt.Sprintf(`UPDATE conversations SET %[1]s = NOT %[1]s
+		 WHERE id = $1 AND user_id = $2
+		 RETURNING id, user_id, title, max_tokens, temperature, system_prompt, archived, pinned, created_at, updated_at`, column),
+		conversationID, userID,
+	).Scan(&conv.ID, &conv.UserID, &conv.Title, &conv.MaxTokens, &conv.Temperature, &conv.SystemPrompt, &conv.Archived, &conv.Pinned, &conv.CreatedAt, &conv.UpdatedAt)
+
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error updating conversation", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conv)
+}
+
+type MergeConversationsRequest struct {
+	SourceID string `json:"sourceId"`
+	TargetID string `json:"targetId"`
+}
+
+// MergeConversations appends the source conversation's messages to the target
+// and deletes the source. Source messages are shifted in time when needed so
+// they sort after the target's existing messages.
+func (h *ChatHandler) MergeConversations(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req MergeConversationsRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.SourceID == "" || req.TargetID == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "sourceId and targetId are required")
+		return
+	}
+	if req.SourceID == req.TargetID {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Cannot merge a conversation into itself")
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Verify both conversations belong to user, locking them for the merge
+	var owned int
+	err = tx.QueryRow(
+		`SELECT COUNT(*) FROM (
+			SELECT id FROM conversations WHERE id IN ($1, $2) AND user_id = $3 FOR UPDATE
+		 ) owned`,
+		req.SourceID, req.TargetID, userID,
+	).Scan(&owned)
+	if err != nil && !isInvalidID(err) {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	if owned != 2 {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+
+	// The merged history must still alternate roles at the seam
+	var targetLastRole, sourceFirstRole string
+	err = tx.QueryRow(
+		`SELECT role FROM messages WHERE conversation_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC LIMIT 1`,
+		req.TargetID,
+	).Scan(&targetLastRole)
+	if err != nil && err != sql.ErrNoRows {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	err = tx.QueryRow(
+		`SELECT role FROM messages WHERE conversation_id = $1 AND deleted_at IS NULL ORDER BY created_at ASC LIMIT 1`,
+		req.SourceID,
+	).Scan(&sourceFirstRole)
+	if err != nil && err != sql.ErrNoRows {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	if targetLastRole != "" && targetLastRole == sourceFirstRole {
+		writeJSONError(w, http.StatusConflict, codeConflict, "Merging would place two messages from the same role in a row")
+		return
+	}
+
+	_, err = tx.Exec(
+		`UPDATE messages SET conversation_id = $1,
+			created_at = created_at + GREATEST(INTERVAL '0',
+				(SELECT MAX(created_at) FROM messages WHERE conversation_id = $1) -
+				(SELECT MIN(created_at) FROM messages WHERE conversation_id = $2) +
+				INTERVAL '1 millisecond')
+		 WHERE conversation_id = $2`,
+		req.TargetID, req.SourceID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error merging conversations", err)
+		return
+	}
+
+	// The target keeps the source's tags
+	_, err = tx.Exec(
+		`INSERT INTO conversation_tags (conversation_id, tag_id)
+		 SELECT $1, tag_id FROM conversation_tags WHERE conversation_id = $2
+		 ON CONFLICT DO NOTHING`,
+		req.TargetID, req.SourceID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error merging conversations", err)
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM conversations WHERE id = $1`, req.SourceID); err != nil {
+		writeInternalError(w, "Error merging conversations", err)
+		return
+	}
+
+	if _, err = tx.Exec(`UPDATE conversations SET updated_at = CURRENT_TIMESTAMP WHERE id = $1`, req.TargetID); err != nil {
+		writeInternalError(w, "Error merging conversations", err)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		writeInternalError(w, "Error merging conversations", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversationId": req.TargetID,
+	})
+}
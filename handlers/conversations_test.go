@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/config"
+	"github.com/diyorend/dashGPT-backend/dbtest"
+	"github.com/diyorend/dashGPT-backend/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newTestChatHandler returns a chat handler replying through provider
+func newTestChatHandler(db *sql.DB, provider LLMProvider) *ChatHandler {
+	return NewChatHandler(db, provider, nil, config.Chat{})
+}
+
+// chatRouter mounts the chat routes the tests exercise, so URL params resolve
+func chatRouter(h *ChatHandler) http.Handler {
+	r := chi.NewRouter()
+	r.Post("/api/chat", h.SendMessage)
+	r.Get("/api/chat/history", h.GetHistory)
+	r.Patch("/api/chat/conversations/{id}", h.RenameConversation)
+	r.Delete("/api/chat/conversations/{id}", h.DeleteConversation)
+	r.Post("/api/chat/conversations/merge", h.MergeConversations)
+	r.Post("/api/chat/conversations/{id}/archive", h.ArchiveConversation)
+	r.Post("/api/chat/conversations/{id}/pin", h.PinConversation)
+	r.Get("/api/chat/conversations/{id}/pinned", h.GetPinnedMessages)
+	r.Get("/api/chat/conversations/{id}/replay", h.ReplayLastResponse)
+	r.Post("/api/chat/conversations/{id}/tags/{tagId}", h.TagConversation)
+	r.Delete("/api/chat/conversations/{id}/tags/{tagId}", h.UntagConversation)
+	r.Put("/api/chat/messages/{id}", h.EditMessage)
+	r.Post("/api/chat/messages/{id}/pin", h.PinMessage)
+	r.Delete("/api/chat/messages/{id}/pin", h.UnpinMessage)
+	r.Post("/api/chat/messages/{id}/feedback", h.SubmitFeedback)
+	r.Get("/api/chat/attachments/{id}", h.GetAttachment)
+	return r
+}
+
+// serveAs sends a request to handler as if authenticated as userID
+func serveAs(handler http.Handler, userID, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, userID))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestConversationsAreScopedToTheirOwner(t *testing.T) {
+	db := dbtest.Open(t)
+	owner := dbtest.CreateUser(t, db, "owner@example.com")
+	other := dbtest.CreateUser(t, db, "other@example.com")
+	conversationID := dbtest.CreateConversation(t, db, owner)
+
+	router := chatRouter(newTestChatHandler(db, &FakeProvider{Response: "Should not be sent"}))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"send message", http.MethodPost, "/api/chat", `{"message":"Hi","conversationId":"` + conversationID + `"}`},
+		{"read history", http.MethodGet, "/api/chat/history?conversationId=" + conversationID, ""},
+		{"rename", http.MethodPatch, "/api/chat/conversations/" + conversationID, `{"title":"Taken over"}`},
+		{"delete", http.MethodDelete, "/api/chat/conversations/" + conversationID, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAs(router, other, tt.method, tt.path, tt.body)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusNotFound, w.Body)
+			}
+		})
+	}
+
+	var title string
+	var messages int
+	err := db.QueryRow(
+		`SELECT c.title, (SELECT COUNT(*) FROM messages m WHERE m.conversation_id = c.id)
+		 FROM conversations c WHERE c.id = $1`,
+		conversationID,
+	).Scan(&title, &messages)
+	if err != nil {
+		t.Fatalf("owner's conversation is gone: %v", err)
+	}
+	if title == "Taken over" {
+		t.Error("conversation was renamed by another user")
+	}
+	if messages != 2 {
+		t.Errorf("conversation has %d messages, want 2", messages)
+	}
+
+	// The owner still has access
+	if w := serveAs(router, owner, http.MethodGet, "/api/chat/history?conversationId="+conversationID, ""); w.Code != http.StatusOK {
+		t.Errorf("owner history status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestMalformedIDsAreNotFound(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "malformed@example.com")
+	router := chatRouter(newTestChatHandler(db, &FakeProvider{Response: "Should not be sent"}))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"rename conversation", http.MethodPatch, "/api/chat/conversations/not-a-uuid", `{"title":"Renamed"}`},
+		{"delete conversation", http.MethodDelete, "/api/chat/conversations/not-a-uuid", ""},
+		{"archive conversation", http.MethodPost, "/api/chat/conversations/not-a-uuid/archive", ""},
+		{"pin conversation", http.MethodPost, "/api/chat/conversations/not-a-uuid/pin", ""},
+		{"pinned messages", http.MethodGet, "/api/chat/conversations/not-a-uuid/pinned", ""},
+		{"replay", http.MethodGet, "/api/chat/conversations/not-a-uuid/replay", ""},
+		{"tag conversation", http.MethodPost, "/api/chat/conversations/not-a-uuid/tags/not-a-uuid", ""},
+		{"untag conversation", http.MethodDelete, "/api/chat/conversations/not-a-uuid/tags/not-a-uuid", ""},
+		{"edit message", http.MethodPut, "/api/chat/messages/not-a-uuid", `{"content":"Edited"}`},
+		{"pin message", http.MethodPost, "/api/chat/messages/not-a-uuid/pin", ""},
+		{"unpin message", http.MethodDelete, "/api/chat/messages/not-a-uuid/pin", ""},
+		{"message feedback", http.MethodPost, "/api/chat/messages/not-a-uuid/feedback", `{"rating":"up"}`},
+		{"attachment", http.MethodGet, "/api/chat/attachments/not-a-uuid", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAs(router, userID, tt.method, tt.path, tt.body)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusNotFound, w.Body)
+			}
+		})
+	}
+}
+
+// createConversationWith inserts a conversation with messages given as
+// "role:content", the first age ago and each following a second later
+func createConversationWith(t *testing.T, db *sql.DB, userID string, age time.Duration, messages ...string) string {
+	t.Helper()
+
+	var id string
+	if err := db.QueryRow(`INSERT INTO conversations (user_id) VALUES ($1) RETURNING id`, userID).Scan(&id); err != nil {
+		t.Fatalf("creating conversation: %v", err)
+	}
+	for i, m := range messages {
+		role, content, _ := strings.Cut(m, ":")
+		_, err := db.Exec(
+			`INSERT INTO messages (conversation_id, role, content, created_at)
+			 VALUES ($1, $2, $3, NOW() - $4 * INTERVAL '1 second')`,
+			id, role, content, int64(age.Seconds())-int64(i),
+		)
+		if err != nil {
+			t.Fatalf("creating message: %v", err)
+		}
+	}
+	return id
+}
+
+// conversationContents returns the contents of a conversation's messages in
+// the order they are shown
+func conversationContents(t *testing.T, db *sql.DB, conversationID string) []string {
+	t.Helper()
+
+	rows, err := db.Query(
+		`SELECT content FROM messages WHERE conversation_id = $1 AND deleted_at IS NULL ORDER BY created_at`,
+		conversationID,
+	)
+	if err != nil {
+		t.Fatalf("fetching messages: %v", err)
+	}
+	defer rows.Close()
+
+	var contents []string
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			t.Fatalf("scanning message: %v", err)
+		}
+		contents = append(contents, content)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("fetching messages: %v", err)
+	}
+	return contents
+}
+
+func TestMergeConversations(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "merger@example.com")
+	target := createConversationWith(t, db, userID, time.Minute, "user:Target question", "assistant:Target answer")
+	// Older than the target, so its messages must be shifted to follow it
+	source := createConversationWith(t, db, userID, time.Hour, "user:Source question", "assistant:Source answer")
+
+	var tagID string
+	if err := db.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'work') RETURNING id`, userID).Scan(&tagID); err != nil {
+		t.Fatalf("creating tag: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO conversation_tags (conversation_id, tag_id) VALUES ($1, $2)`, source, tagID); err != nil {
+		t.Fatalf("tagging conversation: %v", err)
+	}
+
+	router := chatRouter(newTestChatHandler(db, &FakeProvider{}))
+	w := serveAs(router, userID, http.MethodPost, "/api/chat/conversations/merge", `{"sourceId":"`+source+`","targetId":"`+target+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	want := []string{"Target question", "Target answer", "Source question", "Source answer"}
+	if got := conversationContents(t, db, target); !reflect.DeepEqual(got, want) {
+		t.Errorf("merged messages = %q, want %q", got, want)
+	}
+
+	var sourceExists, tagged bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM conversations WHERE id = $1)`, source).Scan(&sourceExists); err != nil {
+		t.Fatalf("checking source: %v", err)
+	}
+	if sourceExists {
+		t.Error("source conversation was not deleted")
+	}
+	err := db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM conversation_tags WHERE conversation_id = $1 AND tag_id = $2)`,
+		target, tagID,
+	).Scan(&tagged)
+	if err != nil {
+		t.Fatalf("checking tags: %v", err)
+	}
+	if !tagged {
+		t.Error("target didn't keep the source's tag")
+	}
+}
+
+func TestMergeConversationsRejected(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "merger@example.com")
+	other := dbtest.CreateUser(t, db, "other@example.com")
+	target := createConversationWith(t, db, userID, time.Minute, "user:Target question", "assistant:Target answer")
+	source := createConversationWith(t, db, userID, time.Hour, "user:Source question", "assistant:Source answer")
+	othersConversation := createConversationWith(t, db, other, time.Hour, "user:Other question", "assistant:Other answer")
+	// Starts with a reply, which can't follow the target's reply
+	continuation := createConversationWith(t, db, userID, time.Hour, "assistant:Continued answer")
+
+	router := chatRouter(newTestChatHandler(db, &FakeProvider{}))
+
+	tests := []struct {
+		name           string
+		source, target string
+		wantStatus     int
+	}{
+		{"another user's source", othersConversation, target, http.StatusNotFound},
+		{"another user's target", source, othersConversation, http.StatusNotFound},
+		{"malformed id", "not-a-uuid", target, http.StatusNotFound},
+		{"same role at the seam", continuation, target, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"sourceId":"` + tt.source + `","targetId":"` + tt.target + `"}`
+			w := serveAs(router, userID, http.MethodPost, "/api/chat/conversations/merge", body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+
+	// Nothing was moved
+	for id, want := range map[string][]string{
+		target:             {"Target question", "Target answer"},
+		source:             {"Source question", "Source answer"},
+		othersConversation: {"Other question", "Other answer"},
+		continuation:       {"Continued answer"},
+	} {
+		if got := conversationContents(t, db, id); !reflect.DeepEqual(got, want) {
+			t.Errorf("messages = %q, want %q", got, want)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/diyorend/dashGPT-backend/models"
@@ -21,17 +24,25 @@ func NewDashboardHandler(db *sql.DB) *DashboardHandler {
 func (h *DashboardHandler) GetMetrics(w http.ResponseWriter, r *http.Request) {
 	userID := GetUserID(r)
 	if userID == "" {
-		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	hasData, err := h.userHasData(userID)
+	if err != nil {
+		writeInternalError(w, "Database error", err)
 		return
 	}
 
 	// In a real application, we would fetch these from your database
 	// For demo purposes, we'll generate realistic mock data
+	rng := newDemoRand()
 	metrics := models.DashboardMetrics{
-		TotalUsers:  1250 + rand.Intn(100),
-		Revenue:     45678.50 + float64(rand.Intn(10000)),
-		Growth:      12.5 + float64(rand.Intn(10)),
-		ActiveUsers: 890 + rand.Intn(50),
+		TotalUsers:  1250 + rng.Intn(100),
+		Revenue:     45678.50 + float64(rng.Intn(10000)),
+		Growth:      12.5 + float64(rng.Intn(10)),
+		ActiveUsers: 890 + rng.Intn(50),
+		HasData:     hasData,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -41,14 +52,138 @@ func (h *DashboardHandler) GetMetrics(w http.ResponseWriter, r *http.Request) {
 func (h *DashboardHandler) GetChartData(w http.ResponseWriter, r *http.Request) {
 	userID := GetUserID(r)
 	if userID == "" {
-		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	from, to, days, errMsg := parseChartRange(r)
+	if errMsg != "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, errMsg)
+		return
+	}
+
+	chartData, err := h.chartData(userID, from, to, days)
+	if err != nil {
+		writeInternalError(w, "Database error", err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chartData)
+}
+
+// ExportChartData returns the chart data as a CSV download with one row per day
+func (h *DashboardHandler) ExportChartData(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" && format != "csv" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Unsupported format")
+		return
+	}
+
+	from, to, days, errMsg := parseChartRange(r)
+	if errMsg != "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, errMsg)
+		return
+	}
+
+	chartData, err := h.chartData(userID, from, to, days)
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	filename := fmt.Sprintf("charts_%s_%s.csv", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	// The series share the same days, so rows can be built by index
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "revenue", "users", "engagement"})
+	for i, point := range chartData.Revenue {
+		cw.Write([]string{
+			point.Date,
+			strconv.FormatFloat(point.Value, 'f', 2, 64),
+			strconv.FormatFloat(chartData.Users[i].Value, 'f', -1, 64),
+			strconv.FormatFloat(chartData.Engagement[i].Value, 'f', -1, 64),
+		})
+	}
+	cw.Flush()
+}
+
+// chartData builds the chart series for the given range
+func (h *DashboardHandler) chartData(userID string, from, to time.Time, days int) (models.ChartData, error) {
+	hasData, err := h.userHasData(userID)
+	if err != nil {
+		return models.ChartData{}, err
+	}
+
+	// Users are daily signups and engagement is the user's daily message count
+	users, err := h.dailyCounts(`SELECT created_at::date, COUNT(*) FROM users
+		 WHERE created_at >= $1::date AND created_at < $2::date + 1
+		 GROUP BY 1`, from, to)
+	if err != nil {
+		return models.ChartData{}, err
+	}
+
+	engagement, err := h.dailyCounts(`SELECT m.created_at::date, COUNT(*) FROM messages m
+		 JOIN conversations c ON c.id = m.conversation_id
+		 WHERE m.created_at >= $1::date AND m.created_at < $2::date + 1 AND c.user_id = $3 AND m.deleted_at IS NULL
+		 GROUP BY 1`, from, to, userID)
+	if err != nil {
+		return models.ChartData{}, err
+	}
+
+	// Revenue isn't tracked yet, so it remains mock data
+	rng := newDemoRand()
+	return models.ChartData{
+		Revenue:    generateChartData(rng, to, days, 1000, 5000),
+		Users:      users,
+		Engagement: engagement,
+		HasData:    hasData,
+	}, nil
+}
+
+// maxChartDays caps custom chart ranges to keep responses reasonably sized
+const maxChartDays = 731
+
+// parseChartRange reads the chart date range from either explicit from and to
+// dates (YYYY-MM-DD) or a preset range param, defaulting to the last 7 days.
+// errMsg is set if the params are invalid.
+func parseChartRange(r *http.Request) (from, to time.Time, days int, errMsg string) {
+	fromParam := r.URL.Query().Get("from")
+	toParam := r.URL.Query().Get("to")
+	if fromParam != "" || toParam != "" {
+		if fromParam == "" || toParam == "" {
+			return from, to, 0, "from and to must be provided together"
+		}
+
+		var err error
+		from, err = time.Parse("2006-01-02", fromParam)
+		if err != nil {
+			return from, to, 0, "from must be a date in YYYY-MM-DD format"
+		}
+		to, err = time.Parse("2006-01-02", toParam)
+		if err != nil {
+			return from, to, 0, "to must be a date in YYYY-MM-DD format"
+		}
+		if from.After(to) {
+			return from, to, 0, "from must not be after to"
+		}
+
+		days = int(to.Sub(from).Hours()/24) + 1
+		if days > maxChartDays {
+			return from, to, 0, fmt.Sprintf("date range must not exceed %d days", maxChartDays)
+		}
+		return from, to, days, ""
+	}
+
 	// Get date range from query params (default to 7 days)
-	rangeParam := r.URL.Query().Get("range")
-	days := 7
-	switch rangeParam {
+	switch r.URL.Query().Get("range") {
 	case "30d":
 		days = 30
 	case "90d":
@@ -59,27 +194,69 @@ func (h *DashboardHandler) GetChartData(w http.ResponseWriter, r *http.Request)
 		days = 7
 	}
 
-	// Generate mock chart data
-	chartData := models.ChartData{
-		Revenue:    generateChartData(days, 1000, 5000),
-		Users:      generateChartData(days, 50, 200),
-		Engagement: generateChartData(days, 60, 100),
+	to = time.Now()
+	from = to.AddDate(0, 0, -days+1)
+	return from, to, days, ""
+}
+
+// userHasData reports whether the user has any chat activity yet, so the
+// frontend can show an onboarding state instead of empty charts
+func (h *DashboardHandler) userHasData(userID string) (bool, error) {
+	var exists bool
+	err := h.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM conversations WHERE user_id = $1)`,
+		userID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// dailyCounts runs a query grouping counts by day, taking the from and to
+// dates as $1 and $2, and returns one point per day in the range with days
+// that have no rows filled in as zero
+func (h *DashboardHandler) dailyCounts(query string, from, to time.Time, args ...interface{}) ([]models.ChartDataPoint, error) {
+	args = append([]interface{}{from.Format("2006-01-02"), to.Format("2006-01-02")}, args...)
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(chartData)
+	counts := make(map[string]float64)
+	for rows.Next() {
+		var day time.Time
+		var count float64
+		if err := rows.Scan(&day, &count); err != nil {
+			return nil, err
+		}
+		counts[day.Format("2006-01-02")] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	data := []models.ChartDataPoint{}
+	for day := from; day.Format("2006-01-02") <= to.Format("2006-01-02"); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		data = append(data, models.ChartDataPoint{Date: date, Value: counts[date]})
+	}
+	return data, nil
+}
+
+// newDemoRand returns a random source owned by a single request, so demo data
+// generation never shares mutable state between concurrent requests
+func newDemoRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
 }
 
-func generateChartData(days int, minValue, maxValue float64) []models.ChartDataPoint {
+func generateChartData(rng *rand.Rand, end time.Time, days int, minValue, maxValue float64) []models.ChartDataPoint {
 	data := make([]models.ChartDataPoint, days)
-	now := time.Now()
 	baseValue := minValue + (maxValue-minValue)/2
 
 	for i := 0; i < days; i++ {
-		date := now.AddDate(0, 0, -days+i+1)
+		date := end.AddDate(0, 0, -days+i+1)
 
 		// Add some realistic variation
-		variation := (rand.Float64() - 0.5) * (maxValue - minValue) * 0.3
+		variation := (rng.Float64() - 0.5) * (maxValue - minValue) * 0.3
 		trend := float64(i) * (maxValue - minValue) / float64(days) * 0.5
 		value := baseValue + variation + trend
 
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/diyorend/dashGPT-backend/dbtest"
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// dashboardRouter mounts the dashboard routes
+func dashboardRouter(h *DashboardHandler) http.Handler {
+	r := chi.NewRouter()
+	r.Get("/api/dashboard/metrics", h.GetMetrics)
+	r.Get("/api/dashboard/charts", h.GetChartData)
+	r.Get("/api/dashboard/charts/export", h.ExportChartData)
+	return r
+}
+
+func TestDashboardHasData(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "fresh@example.com")
+	router := dashboardRouter(NewDashboardHandler(db))
+
+	check := func(wantHasData bool) models.ChartData {
+		t.Helper()
+
+		w := serveAs(router, userID, http.MethodGet, "/api/dashboard/metrics", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("metrics status = %d, want %d; body: %s", w.Code, http.StatusOK, w.Body)
+		}
+		var metrics map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&metrics); err != nil {
+			t.Fatalf("decoding metrics: %v", err)
+		}
+		// Numeric fields stay present alongside the flag
+		for _, field := range []string{"totalUsers", "revenue", "growth", "activeUsers"} {
+			if _, ok := metrics[field].(float64); !ok {
+				t.Errorf("metrics %s = %v, want a number", field, metrics[field])
+			}
+		}
+		if metrics["hasData"] != wantHasData {
+			t.Errorf("metrics hasData = %v, want %t", metrics["hasData"], wantHasData)
+		}
+
+		w = serveAs(router, userID, http.MethodGet, "/api/dashboard/charts?range=7d", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("charts status = %d, want %d; body: %s", w.Code, http.StatusOK, w.Body)
+		}
+		var charts models.ChartData
+		if err := json.NewDecoder(w.Body).Decode(&charts); err != nil {
+			t.Fatalf("decoding charts: %v", err)
+		}
+		if charts.HasData != wantHasData {
+			t.Errorf("charts hasData = %t, want %t", charts.HasData, wantHasData)
+		}
+		for name, series := range map[string][]models.ChartDataPoint{
+			"revenue":    charts.Revenue,
+			"users":      charts.Users,
+			"engagement": charts.Engagement,
+		} {
+			if len(series) != 7 {
+				t.Errorf("%s has %d points, want 7", name, len(series))
+			}
+		}
+		return charts
+	}
+
+	// Without activity, engagement is all zeros rather than demo data
+	for _, point := range check(false).Engagement {
+		if point.Value != 0 {
+			t.Errorf("engagement on %s = %v for a new user, want 0", point.Date, point.Value)
+		}
+	}
+
+	dbtest.CreateConversation(t, db, userID)
+	check(true)
+}
+
+// Run with -race to check concurrent requests share no mutable state
+func TestDashboardConcurrentRequests(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "busy@example.com")
+	dbtest.CreateConversation(t, db, userID)
+	router := dashboardRouter(NewDashboardHandler(db))
+
+	paths := []string{
+		"/api/dashboard/metrics",
+		"/api/dashboard/charts?range=30d",
+		"/api/dashboard/charts/export?range=90d",
+	}
+	const requestsPerPath = 10
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, len(paths)*requestsPerPath)
+	for _, path := range paths {
+		for i := 0; i < requestsPerPath; i++ {
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				statuses <- serveAs(router, userID, http.MethodGet, path, "").Code
+			}(path)
+		}
+	}
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("status = %d, want %d", status, http.StatusOK)
+		}
+	}
+}
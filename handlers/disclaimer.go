@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ContentClassifier detects which content categories a response falls into
+type ContentClassifier interface {
+	Classify(text string) []string
+}
+
+// KeywordClassifier matches categories by case-insensitive keywords. Keywords
+// only match whole words, optionally pluralized, so "tax" matches "taxes" but
+// not "syntax".
+type KeywordClassifier struct {
+	patterns map[string]*regexp.Regexp // category -> any of its keywords
+}
+
+// NewKeywordClassifier compiles keywords, given per category, into a classifier
+func NewKeywordClassifier(keywords map[string][]string) *KeywordClassifier {
+	c := &KeywordClassifier{patterns: make(map[string]*regexp.Regexp, len(keywords))}
+	for category, words := range keywords {
+		alternatives := make([]string, len(words))
+		for i, word := range words {
+			// Words in a phrase may be separated by any whitespace
+			alternatives[i] = strings.Join(strings.Fields(regexp.QuoteMeta(strings.ToLower(word))), `\s+`)
+		}
+		c.patterns[category] = regexp.MustCompile(`\b(?:` + strings.Join(alternatives, "|") + `)(?:s|es)?\b`)
+	}
+	return c
+}
+
+func (c *KeywordClassifier) Classify(text string) []string {
+	text = strings.ToLower(text)
+
+	var categories []string
+	for category, pattern := range c.patterns {
+		if pattern.MatchString(text) {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+var defaultDisclaimerKeywords = NewKeywordClassifier(map[string][]string{
+	"medical":   {"diagnosis", "symptom", "medication", "dosage", "treatment", "prescription"},
+	"legal":     {"legal advice", "lawsuit", "attorney", "lawyer", "liability", "court"},
+	"financial": {"investment", "invest in", "stock", "portfolio", "tax", "retirement"},
+})
+
+var defaultDisclaimerMessages = map[string]string{
+	"medical":   "This is not medical advice. Please consult a qualified healthcare professional.",
+	"legal":     "This is not legal advice. Please consult a licensed attorney.",
+	"financial": "This is not financial advice. Please consult a qualified financial advisor.",
+}
+
+// Disclaimers appends compliance notices to responses whose content falls into
+// configured categories
+type Disclaimers struct {
+	Classifier ContentClassifier
+	Messages   map[string]string // category -> disclaimer text
+}
+
+// NewDefaultDisclaimers returns keyword-based disclaimers for the given
+// categories. Unknown categories are ignored.
+func NewDefaultDisclaimers(categories []string) *Disclaimers {
+	d := &Disclaimers{
+		Classifier: defaultDisclaimerKeywords,
+		Messages:   make(map[string]string),
+	}
+	for _, category := range categories {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if msg, ok := defaultDisclaimerMessages[category]; ok {
+			d.Messages[category] = msg
+		}
+	}
+	return d
+}
+
+// For returns the disclaimer text to append to a response, or "" if none apply
+func (d *Disclaimers) For(text string) string {
+	var notices []string
+	for _, category := range d.Classifier.Classify(text) {
+		if msg, ok := d.Messages[category]; ok {
+			notices = append(notices, msg)
+		}
+	}
+	if len(notices) == 0 {
+		return ""
+	}
+	return "\n\n---\n" + strings.Join(notices, "\n")
+}
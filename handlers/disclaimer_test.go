@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeywordClassifier(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		// Keywords inside other words don't match
+		{"Go's syntax is simple.", nil},
+		{"Thanks for the courtesy.", nil},
+		{"The farm raises livestock.", nil},
+		{"She was attorneyish in manner.", nil},
+		{"Have you tried the new restaurant downtown?", nil},
+
+		// Whole words match regardless of case and punctuation
+		{"You may owe tax on that.", []string{"financial"}},
+		{"Taxes are due in April.", []string{"financial"}},
+		{"Buy the stock, or stocks in general?", []string{"financial"}},
+		{"Take it to court.", []string{"legal"}},
+		{"This isn't LEGAL\nADVICE.", []string{"legal"}},
+		{"A common symptom is fatigue", []string{"medical"}},
+		{"Ask a lawyer about the tax treatment.", []string{"financial", "legal", "medical"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := defaultDisclaimerKeywords.Classify(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Classify(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisclaimersFor(t *testing.T) {
+	d := NewDefaultDisclaimers([]string{"Financial", "unknown"})
+
+	if got := d.For("Fix the syntax error."); got != "" {
+		t.Errorf("disclaimer for unrelated text = %q, want none", got)
+	}
+	// Only configured categories get a disclaimer
+	if got := d.For("Ask your lawyer."); got != "" {
+		t.Errorf("disclaimer for unconfigured category = %q, want none", got)
+	}
+	if got, want := d.For("Index funds are a common investment."), "\n\n---\n"+defaultDisclaimerMessages["financial"]; got != want {
+		t.Errorf("disclaimer = %q, want %q", got, want)
+	}
+}
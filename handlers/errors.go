@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Error codes identify the kind of failure in error responses. Clients may
+// rely on them; messages are meant for people and may change.
+const (
+	codeInvalidRequest     = "invalid_request"
+	codeUnauthorized       = "unauthorized"
+	codeInvalidCredentials = "invalid_credentials"
+	codeInvalidToken       = "invalid_token"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeConflict           = "conflict"
+	codePayloadTooLarge    = "payload_too_large"
+	codeQuotaExceeded      = "quota_exceeded"
+	codeContentBlocked     = "content_blocked"
+	codeInternal           = "internal_error"
+)
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSONError writes an error response. Messages must not include internal
+// details such as database or upstream errors; log those instead.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+// writeInternalError logs err and writes a 500 response with message, keeping
+// the error's details out of the response
+func writeInternalError(w http.ResponseWriter, message string, err error) {
+	slog.Error(message, "error", err)
+	writeJSONError(w, http.StatusInternalServerError, codeInternal, message)
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/diyorend/dashGPT-backend/middleware"
+	"github.com/diyorend/dashGPT-backend/tokens"
+)
+
+func TestErrorResponses(t *testing.T) {
+	// Queries fail without reaching a server, as if the database were down
+	closedDB, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedDB.Close()
+	h := newTestChatHandler(closedDB, &FakeProvider{})
+
+	requireAuth := middleware.AuthMiddleware(tokens.NewHMACKeySet("test-secret"), nil)
+
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		userID      string
+		path        string
+		header      http.Header
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{
+			name:        "invalid parameter",
+			handler:     http.HandlerFunc(h.GetUsage),
+			userID:      "00000000-0000-0000-0000-000000000001",
+			path:        "/api/chat/usage?groupBy=day",
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    codeInvalidRequest,
+			wantMessage: "groupBy must be month",
+		},
+		{
+			name:        "missing token",
+			handler:     requireAuth(http.HandlerFunc(h.GetUsage)),
+			path:        "/api/chat/usage",
+			wantStatus:  http.StatusUnauthorized,
+			wantCode:    codeUnauthorized,
+			wantMessage: "Authorization header required",
+		},
+		{
+			name:        "invalid token",
+			handler:     requireAuth(http.HandlerFunc(h.GetUsage)),
+			path:        "/api/chat/usage",
+			header:      http.Header{"Authorization": {"Bearer not-a-jwt"}},
+			wantStatus:  http.StatusUnauthorized,
+			wantCode:    codeInvalidToken,
+			wantMessage: "Invalid or expired token",
+		},
+		{
+			name:        "database error",
+			handler:     http.HandlerFunc(h.GetUsage),
+			userID:      "00000000-0000-0000-0000-000000000001",
+			path:        "/api/chat/usage",
+			wantStatus:  http.StatusInternalServerError,
+			wantCode:    codeInternal,
+			wantMessage: "Error fetching usage",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if tt.userID != "" {
+				r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, tt.userID))
+			}
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+
+			// Decode strictly, so any field beyond the envelope fails
+			var body ErrorResponse
+			dec := json.NewDecoder(strings.NewReader(w.Body.String()))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&body); err != nil {
+				t.Fatalf("decoding error body %s: %v", w.Body, err)
+			}
+			want := ErrorDetail{Code: tt.wantCode, Message: tt.wantMessage}
+			if body.Error != want {
+				t.Errorf("error = %+v, want %+v", body.Error, want)
+			}
+		})
+	}
+}
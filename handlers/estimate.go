@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/diyorend/dashGPT-backend/models"
+)
+
+type EstimateRequest struct {
+	Message        string `json:"message"`
+	ConversationID string `json:"conversationId,omitempty"`
+	Model          string `json:"model,omitempty"`
+}
+
+// Estimate is the approximate size and cost of sending a message. Costs are in
+// US dollars and omitted if the model has no configured price.
+type Estimate struct {
+	Model           string   `json:"model"`
+	InputTokens     int      `json:"inputTokens"`
+	MaxOutputTokens int      `json:"maxOutputTokens"`
+	InputCost       *float64 `json:"inputCost,omitempty"`
+	MaxCost         *float64 `json:"maxCost,omitempty"`
+}
+
+// EstimateTokens estimates the tokens and cost of sending a draft message,
+// assembling the request SendMessage would make without calling the model.
+// Tokens are estimated heuristically, so the figures are approximate.
+func (h *ChatHandler) EstimateTokens(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req EstimateRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.Message == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Message is required")
+		return
+	}
+	if chatErr := h.messageLengthError(req.Message); chatErr != nil {
+		chatErr.write(w)
+		return
+	}
+	if req.Model != "" && !isAllowedModel(req.Model) {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Unsupported model")
+		return
+	}
+
+	defaults, err := h.getUserSettings(userID)
+	if err != nil {
+		writeInternalError(w, "Error fetching settings", err)
+		return
+	}
+
+	// A new conversation starts with the defaults; an existing one uses its
+	// own settings and history
+	settings := generationSettings{maxTokens: defaultMaxTokens}
+	if defaults.SystemPrompt != nil {
+		settings.systemPrompt = *defaults.SystemPrompt
+	}
+	var history []models.Message
+	if req.ConversationID != "" {
+		owned, err := h.userOwnsConversation(userID, req.ConversationID)
+		if err != nil {
+			writeInternalError(w, "Error fetching conversation", err)
+			return
+		}
+		if !owned {
+			writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+			return
+		}
+
+		if settings, err = h.getGenerationSettings(req.ConversationID); err != nil {
+			writeInternalError(w, "Error fetching conversation settings", err)
+			return
+		}
+		if history, err = h.getConversationMessages(req.ConversationID); err != nil {
+			writeInternalError(w, "Error fetching conversation history", err)
+			return
+		}
+	}
+	history = append(history, models.Message{Role: "user", Content: req.Message})
+
+	opts := CompletionOptions{
+		Model:  resolveModel(req.Model, defaults),
+		System: settings.systemPrompt,
+	}
+	opts.MaxTokens = min(settings.maxTokens, maxReplyTokens(opts.Model))
+	history = alternateRoles(trimToContextWindow(history, h.historyBudget(opts)))
+
+	estimate := Estimate{
+		Model:           opts.Model,
+		InputTokens:     approxTokens(opts.System),
+		MaxOutputTokens: opts.MaxTokens,
+	}
+	for _, msg := range history {
+		estimate.InputTokens += messageTokens(msg)
+	}
+	if price, ok := h.prices[opts.Model]; ok {
+		inputCost := float64(estimate.InputTokens) * price.Input / 1e6
+		maxCost := inputCost + float64(estimate.MaxOutputTokens)*price.Output/1e6
+		estimate.InputCost, estimate.MaxCost = &inputCost, &maxCost
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimate)
+}
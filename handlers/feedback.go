@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxFeedbackCommentLength = 2000
+
+type FeedbackRequest struct {
+	Rating  string `json:"rating"`
+	Comment string `json:"comment"`
+}
+
+// SubmitFeedback records the caller's rating of an assistant reply. Submitting
+// again for the same message replaces the earlier feedback.
+func (h *ChatHandler) SubmitFeedback(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID := chi.URLParam(r, "id")
+
+	var req FeedbackRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.Rating != "up" && req.Rating != "down" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, `Rating must be "up" or "down"`)
+		return
+	}
+
+	req.Comment = strings.TrimSpace(req.Comment)
+	if utf8.RuneCountInString(req.Comment) > maxFeedbackCommentLength {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Comment must be at most 2000 characters")
+		return
+	}
+
+	// Only accept feedback on messages in conversations owned by the user
+	var role string
+	err := h.db.QueryRow(
+		`SELECT m.role FROM messages m
+		 JOIN conversations c ON c.id = m.conversation_id
+		 WHERE m.id = $1 AND c.user_id = $2 AND m.deleted_at IS NULL`,
+		messageID, userID,
+	).Scan(&role)
+
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Message not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error saving feedback", err)
+		return
+	}
+	if role != "assistant" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Feedback can only be given on assistant replies")
+		return
+	}
+
+	var feedback models.MessageFeedback
+	err = h.db.QueryRow(
+		`INSERT INTO message_feedback (message_id, user_id, rating, comment)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (message_id, user_id) DO UPDATE SET
+			rating = EXCLUDED.rating,
+			comment = EXCLUDED.comment,
+			updated_at = CURRENT_TIMESTAMP
+		 RETURNING message_id, user_id, rating, comment, created_at, updated_at`,
+		messageID, userID, req.Rating, req.Comment,
+	).Scan(&feedback.MessageID, &feedback.UserID, &feedback.Rating, &feedback.Comment, &feedback.CreatedAt, &feedback.UpdatedAt)
+
+	if err != nil {
+		writeInternalError(w, "Error saving feedback", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feedback)
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+)
+
+// maxIdempotencyKeyLength matches the idempotency_keys.key column
+const maxIdempotencyKeyLength = 255
+
+// claimIdempotencyKey reserves a user's key for a new request. It returns false
+// if the key is held by an earlier request that hasn't expired.
+func (h *ChatHandler) claimIdempotencyKey(userID, key string) (bool, error) {
+	result, err := h.db.Exec(
+		`INSERT INTO idempotency_keys (user_id, key, expires_at)
+		 VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second')
+		 ON CONFLICT (user_id, key) DO UPDATE
+		 SET conversation_id = NULL, response = NULL, stop_reason = NULL,
+		     completed_at = NULL, expires_at = EXCLUDED.expires_at
+		 WHERE idempotency_keys.expires_at <= CURRENT_TIMESTAMP`,
+		userID, key, int(h.idempotencyKeyTTL.Seconds()),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// completeIdempotencyKey records the reply saved for a request so it can be
+// returned to retries
+func (h *ChatHandler) completeIdempotencyKey(reply replyRequest, text, stopReason string) {
+	_, err := h.db.Exec(
+		`UPDATE idempotency_keys
+		 SET conversation_id = $1, response = $2, stop_reason = NULLIF($3, ''), completed_at = CURRENT_TIMESTAMP
+		 WHERE user_id = $4 AND key = $5`,
+		reply.conversationID, text, stopReason, reply.userID, reply.idempotencyKey,
+	)
+	if err != nil {
+		slog.Error("Error completing idempotency key", "error", err, "user_id", reply.userID)
+	}
+}
+
+// releaseIdempotencyKey frees the key of a request that failed before a reply
+// was saved, so it can be retried
+func (h *ChatHandler) releaseIdempotencyKey(userID, key string) {
+	_, err := h.db.Exec(
+		`DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND completed_at IS NULL`,
+		userID, key,
+	)
+	if err != nil {
+		slog.Error("Error releasing idempotency key", "error", err, "user_id", userID)
+	}
+}
+
+// replayIdempotentReply answers a retried request with the reply saved for the
+// original, streamed in the same event format as SendMessage
+func (h *ChatHandler) replayIdempotentReply(w http.ResponseWriter, r *http.Request, userID, key string) {
+	var conversationID, response, stopReason sql.NullString
+	var completed bool
+	err := h.db.QueryRow(
+		`SELECT conversation_id, response, stop_reason, completed_at IS NOT NULL
+		 FROM idempotency_keys WHERE user_id = $1 AND key = $2`,
+		userID, key,
+	).Scan(&conversationID, &response, &stopReason, &completed)
+
+	if err == sql.ErrNoRows {
+		// The original request failed and released the key after we tried to
+		// claim it; the client should retry
+		writeJSONError(w, http.StatusConflict, codeConflict, "A request with this Idempotency-Key failed, please retry")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error processing message", err)
+		return
+	}
+	if !completed {
+		writeJSONError(w, http.StatusConflict, codeConflict, "A request with this Idempotency-Key is still being processed")
+		return
+	}
+	if !conversationID.Valid {
+		// The conversation has since been deleted
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+
+	sink := newSSESink(w)
+	w.Header().Set("Idempotent-Replayed", "true")
+	sink.send(StreamEvent{Type: "start", ConversationID: conversationID.String})
+	for _, chunk := range splitForReplay(response.String) {
+		if r.Context().Err() != nil {
+			return
+		}
+		sink.send(StreamEvent{Type: "content", Text: chunk})
+	}
+	sink.send(StreamEvent{Type: "end", ConversationID: conversationID.String, StopReason: stopReason.String})
+}
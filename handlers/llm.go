@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LLMMessage is a single conversation turn sent to a provider
+type LLMMessage struct {
+	Role    string  `json:"role"`
+	Content string  `json:"content"`
+	Images  []Image `json:"images,omitempty"`
+}
+
+// Image is an image input attached to a message
+type Image struct {
+	MediaType string `json:"mediaType"`
+	Data      []byte `json:"data"`
+}
+
+// CompletionOptions configure a single completion request
+type CompletionOptions struct {
+	Model       string
+	MaxTokens   int
+	Temperature float64
+	System      string
+}
+
+// Usage is the number of tokens billed for a completion
+type Usage struct {
+	InputTokens  int
+	OutputTokens int
+}
+
+// Delta is an incremental piece of a streamed completion. The final delta
+// before the channel is closed carries the usage and the reason generation
+// stopped, and Err if the stream failed.
+type Delta struct {
+	Text       string
+	Usage      Usage
+	StopReason string
+	Err        error
+}
+
+// LLMProvider generates completions from a language model
+type LLMProvider interface {
+	// StreamCompletion starts a streamed completion. Errors before streaming
+	// starts are returned directly; later errors arrive on the final delta.
+	// Cancelling ctx stops the stream.
+	StreamCompletion(ctx context.Context, messages []LLMMessage, opts CompletionOptions) (<-chan Delta, error)
+	// Complete returns a full, non-streamed completion
+	Complete(ctx context.Context, messages []LLMMessage, opts CompletionOptions) (string, Usage, error)
+}
+
+// FakeProvider is an LLMProvider that replies with canned text, for tests and
+// local development without an API key
+type FakeProvider struct {
+	Response string
+	Usage    Usage
+	Err      error
+	// Delay is how long StreamCompletion waits before returning, like a
+	// provider retrying a failed request
+	Delay time.Duration
+
+	mu       sync.Mutex
+	streamed []CompletionOptions
+}
+
+// Streamed returns the options of each streamed completion requested, in order
+func (p *FakeProvider) Streamed() []CompletionOptions {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]CompletionOptions(nil), p.streamed...)
+}
+
+func (p *FakeProvider) StreamCompletion(ctx context.Context, messages []LLMMessage, opts CompletionOptions) (<-chan Delta, error) {
+	p.mu.Lock()
+	p.streamed = append(p.streamed, opts)
+	p.mu.Unlock()
+
+	if p.Delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(p.Delay):
+		}
+	}
+	if p.Err != nil {
+		return nil, p.Err
+	}
+
+	deltas := make(chan Delta)
+	go func() {
+		defer close(deltas)
+		for _, chunk := range splitForReplay(p.Response) {
+			select {
+			case <-ctx.Done():
+				deltas <- Delta{Err: ctx.Err()}
+				return
+			case deltas <- Delta{Text: chunk}:
+			}
+		}
+		deltas <- Delta{Usage: p.Usage, StopReason: "end_turn"}
+	}()
+	return deltas, nil
+}
+
+func (p *FakeProvider) Complete(ctx context.Context, messages []LLMMessage, opts CompletionOptions) (string, Usage, error) {
+	if p.Err != nil {
+		return "", Usage{}, p.Err
+	}
+	return p.Response, p.Usage, nil
+}
@@ -0,0 +1,502 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (h *ChatHandler) PinMessage(w http.ResponseWriter, r *http.Request) {
+	h.setMessagePinned(w, r, true)
+}
+
+func (h *ChatHandler) UnpinMessage(w http.ResponseWriter, r *http.Request) {
+	h.setMessagePinned(w, r, false)
+}
+
+func (h *ChatHandler) setMessagePinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID := chi.URLParam(r, "id")
+
+	// Only update messages in conversations owned by the user
+	var msg models.Message
+	err := h.db.QueryRow(
+		`UPDATE messages m SET is_pinned = $1
+		 FROM conversations c
+		 WHERE m.id = $2 AND m.conversation_id = c.id AND c.user_id = $3 AND m.deleted_at IS NULL
+		 RETURNING m.id, m.conversation_id, m.role, m.content, COALESCE(m.model, ''), COALESCE(m.stop_reason, ''), m.is_pinned, m.created_at`,
+		pinned, messageID, userID,
+	).Scan(&msg.ID, &msg.ConversationID, &msg.Role, &msg.Content, &msg.Model, &msg.StopReason, &msg.IsPinned, &msg.CreatedAt)
+
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Message not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error updating message", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+func (h *ChatHandler) GetPinnedMessages(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	conversationID := chi.URLParam(r, "id")
+
+	owned, err := h.userOwnsConversation(userID, conversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation", err)
+		return
+	}
+	if !owned {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+
+	messages, err := h.getConversationMessages(conversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching messages", err)
+		return
+	}
+
+	pinned := []models.Message{}
+	for _, msg := range messages {
+		if msg.IsPinned {
+			pinned = append(pinned, msg)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": pinned,
+	})
+}
+
+const (
+	defaultReplayDelay = 20 * time.Millisecond
+	maxReplayDelay     = time.Second
+)
+
+// ReplayLastResponse re-streams the conversation's last assistant message over
+// SSE in the same event format as SendMessage, pacing chunks by the optional
+// delayMs query param
+func (h *ChatHandler) ReplayLastResponse(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	conversationID := chi.URLParam(r, "id")
+
+	delay := defaultReplayDelay
+	if v := r.URL.Query().Get("delayMs"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 || time.Duration(ms)*time.Millisecond > maxReplayDelay {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "delayMs must be between 0 and 1000")
+			return
+		}
+		delay = time.Duration(ms) * time.Millisecond
+	}
+
+	// Fetch the last assistant message, verifying the conversation belongs to user
+	var content string
+	err := h.db.QueryRow(
+		`SELECT m.content FROM messages m
+		 JOIN conversations c ON c.id = m.conversation_id
+		 WHERE c.id = $1 AND c.user_id = $2 AND m.role = 'assistant' AND m.deleted_at IS NULL
+		 ORDER BY m.created_at DESC LIMIT 1`,
+		conversationID, userID,
+	).Scan(&content)
+
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "No response to replay")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error fetching messages", err)
+		return
+	}
+
+	// Set headers for SSE
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	rc := http.NewResponseController(w)
+	send := func(event string) {
+		fmt.Fprintf(w, "data: %s\n\n", event)
+		_ = rc.Flush()
+	}
+
+	send(formatStreamEvent("start", "", conversationID))
+	for _, chunk := range splitForReplay(content) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+		send(formatStreamEvent("content", chunk, ""))
+	}
+	send(formatStreamEvent("end", "", conversationID))
+}
+
+type RegenerateRequest struct {
+	ConversationID string `json:"conversationId"`
+	Model          string `json:"model"`
+}
+
+// RegenerateResponse replaces the conversation's last assistant message with a
+// freshly streamed reply. The model defaults to the one that produced the
+// replaced message, or the user's default if it is no longer supported.
+func (h *ChatHandler) RegenerateResponse(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req RegenerateRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.ConversationID == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "conversationId is required")
+		return
+	}
+	if req.Model != "" && !isAllowedModel(req.Model) {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Unsupported model")
+		return
+	}
+
+	owned, err := h.userOwnsConversation(userID, req.ConversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation", err)
+		return
+	}
+	if !owned {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+
+	// Only a trailing assistant reply can be regenerated
+	var messageID, role, model string
+	err = h.db.QueryRow(
+		`SELECT id, role, COALESCE(model, '') FROM messages
+		 WHERE conversation_id = $1 AND deleted_at IS NULL
+		 ORDER BY created_at DESC LIMIT 1`,
+		req.ConversationID,
+	).Scan(&messageID, &role, &model)
+	if err == sql.ErrNoRows || (err == nil && role != "assistant") {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "The last message is not an assistant reply")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error fetching messages", err)
+		return
+	}
+
+	model, err = h.replyModel(userID, req.Model, model)
+	if err != nil {
+		writeInternalError(w, "Error fetching settings", err)
+		return
+	}
+
+	if !h.checkQuota(w, userID) {
+		return
+	}
+
+	// The replaced reply is kept, hidden, for auditing
+	if _, err := h.db.Exec(`UPDATE messages SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1`, messageID); err != nil {
+		writeInternalError(w, "Error deleting message", err)
+		return
+	}
+
+	messages, err := h.getConversationMessages(req.ConversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation history", err)
+		return
+	}
+
+	settings, err := h.getGenerationSettings(req.ConversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation settings", err)
+		return
+	}
+
+	h.streamReply(r.Context(), newSSESink(w), replyRequest{
+		userID:         userID,
+		conversationID: req.ConversationID,
+		history:        messages,
+		opts: CompletionOptions{
+			Model:       model,
+			MaxTokens:   settings.maxTokens,
+			Temperature: settings.temperature,
+			System:      settings.systemPrompt,
+		},
+	})
+}
+
+type ContinueRequest struct {
+	ConversationID string `json:"conversationId"`
+}
+
+// ContinueResponse asks the model to carry on from the conversation's last
+// assistant message when it was cut off by the token limit. The continuation
+// is streamed like a new reply but appended to the existing message.
+func (h *ChatHandler) ContinueResponse(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req ContinueRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.ConversationID == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "conversationId is required")
+		return
+	}
+
+	owned, err := h.userOwnsConversation(userID, req.ConversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation", err)
+		return
+	}
+	if !owned {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation not found")
+		return
+	}
+
+	messages, err := h.getConversationMessages(req.ConversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation history", err)
+		return
+	}
+
+	// Only a trailing assistant reply that hit the token limit can be continued
+	if len(messages) == 0 {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "The last message is not a truncated assistant reply")
+		return
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "assistant" || last.StopReason != "max_tokens" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "The last message is not a truncated assistant reply")
+		return
+	}
+
+	if !h.checkQuota(w, userID) {
+		return
+	}
+
+	settings, err := h.getGenerationSettings(req.ConversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation settings", err)
+		return
+	}
+
+	model, err := h.replyModel(userID, "", last.Model)
+	if err != nil {
+		writeInternalError(w, "Error fetching settings", err)
+		return
+	}
+
+	// The API rejects a final assistant turn ending in whitespace
+	messages[len(messages)-1].Content = strings.TrimRight(last.Content, " \t\r\n")
+
+	h.streamReply(r.Context(), newSSESink(w), replyRequest{
+		userID:         userID,
+		conversationID: req.ConversationID,
+		history:        messages,
+		opts: CompletionOptions{
+			Model:       model,
+			MaxTokens:   settings.maxTokens,
+			Temperature: settings.temperature,
+			System:      settings.systemPrompt,
+		},
+		continueMessageID: last.ID,
+	})
+}
+
+type EditMessageRequest struct {
+	Content string `json:"content"`
+	Model   string `json:"model"`
+}
+
+// EditMessage replaces a user message with a new one holding the edited
+// content, discards everything after it in the conversation and streams a new
+// assistant reply
+func (h *ChatHandler) EditMessage(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID := chi.URLParam(r, "id")
+
+	var req EditMessageRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.Content == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Content is required")
+		return
+	}
+	if !h.checkMessageLength(w, req.Content) {
+		return
+	}
+
+	if req.Model != "" && !isAllowedModel(req.Model) {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Unsupported model")
+		return
+	}
+
+	// Fetch the message, verifying its conversation belongs to the user
+	var conversationID, role string
+	err := h.db.QueryRow(
+		`SELECT m.conversation_id, m.role FROM messages m
+		 JOIN conversations c ON c.id = m.conversation_id
+		 WHERE m.id = $1 AND c.user_id = $2 AND m.deleted_at IS NULL`,
+		messageID, userID,
+	).Scan(&conversationID, &role)
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Message not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error fetching message", err)
+		return
+	}
+	if role != "user" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Only user messages can be edited")
+		return
+	}
+
+	// As when regenerating, the model defaults to the one that produced the
+	// reply being replaced
+	var previousModel string
+	err = h.db.QueryRow(
+		`SELECT COALESCE(model, '') FROM messages
+		 WHERE conversation_id = $1 AND role = 'assistant' AND deleted_at IS NULL
+		   AND created_at > (SELECT created_at FROM messages WHERE id = $2)
+		 ORDER BY created_at LIMIT 1`,
+		conversationID, messageID,
+	).Scan(&previousModel)
+	if err != nil && err != sql.ErrNoRows {
+		writeInternalError(w, "Error fetching messages", err)
+		return
+	}
+	model, err := h.replyModel(userID, req.Model, previousModel)
+	if err != nil {
+		writeInternalError(w, "Error fetching settings", err)
+		return
+	}
+
+	if !h.checkQuota(w, userID) {
+		return
+	}
+	if chatErr := h.moderationError(r.Context(), req.Content); chatErr != nil {
+		chatErr.write(w)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		writeInternalError(w, "Error editing message", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Hide the edited message and the rest of the conversation, replacing them
+	// with a new message holding the edited content. The hidden messages are
+	// kept unchanged for auditing.
+	_, err = tx.Exec(
+		`UPDATE messages SET deleted_at = CURRENT_TIMESTAMP
+		 WHERE conversation_id = $1 AND deleted_at IS NULL
+		   AND (id = $2 OR created_at > (SELECT created_at FROM messages WHERE id = $2))`,
+		conversationID, messageID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error editing message", err)
+		return
+	}
+
+	var editedID string
+	err = tx.QueryRow(
+		`INSERT INTO messages (conversation_id, role, content, is_pinned)
+		 SELECT conversation_id, role, $1, is_pinned FROM messages WHERE id = $2
+		 RETURNING id`,
+		req.Content, messageID,
+	).Scan(&editedID)
+	if err != nil {
+		writeInternalError(w, "Error editing message", err)
+		return
+	}
+
+	// Images sent with the message still go with the edited content
+	_, err = tx.Exec(
+		`INSERT INTO message_attachments (message_id, media_type, size, data)
+		 SELECT $1, media_type, size, data FROM message_attachments WHERE message_id = $2`,
+		editedID, messageID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error editing message", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, "Error editing message", err)
+		return
+	}
+
+	messages, err := h.getConversationMessages(conversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation history", err)
+		return
+	}
+
+	settings, err := h.getGenerationSettings(conversationID)
+	if err != nil {
+		writeInternalError(w, "Error fetching conversation settings", err)
+		return
+	}
+
+	h.streamReply(r.Context(), newSSESink(w), replyRequest{
+		userID:         userID,
+		conversationID: conversationID,
+		history:        messages,
+		opts: CompletionOptions{
+			Model:       model,
+			MaxTokens:   settings.maxTokens,
+			Temperature: settings.temperature,
+			System:      settings.systemPrompt,
+		},
+		useCache: true,
+	})
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diyorend/dashGPT-backend/dbtest"
+)
+
+func TestEditMessageKeepsTheOriginal(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "editor@example.com")
+	conversationID := dbtest.CreateConversation(t, db, userID)
+
+	var messageID string
+	err := db.QueryRow(`SELECT id FROM messages WHERE conversation_id = $1 AND role = 'user'`, conversationID).Scan(&messageID)
+	if err != nil {
+		t.Fatalf("fetching message: %v", err)
+	}
+
+	router := chatRouter(newTestChatHandler(db, &FakeProvider{Response: "A new reply"}))
+	w := serveAs(router, userID, http.MethodPut, "/api/chat/messages/"+messageID, `{"content":"Hello again"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	rows, err := db.Query(
+		`SELECT role, content, deleted_at IS NOT NULL FROM messages
+		 WHERE conversation_id = $1 ORDER BY created_at, deleted_at IS NULL`,
+		conversationID,
+	)
+	if err != nil {
+		t.Fatalf("fetching messages: %v", err)
+	}
+	defer rows.Close()
+
+	type message struct {
+		role, content string
+		deleted       bool
+	}
+	var got []message
+	for rows.Next() {
+		var m message
+		if err := rows.Scan(&m.role, &m.content, &m.deleted); err != nil {
+			t.Fatalf("scanning message: %v", err)
+		}
+		got = append(got, m)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("fetching messages: %v", err)
+	}
+
+	want := []message{
+		{"user", "Hello", true},
+		{"assistant", "Hi there", true},
+		{"user", "Hello again", false},
+		{"assistant", "A new reply", false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %+v, want %+v", got, want)
+	}
+}
+
+func TestEditMessageModel(t *testing.T) {
+	const (
+		sonnet = "claude-sonnet-4-20250514"
+		opus   = "claude-opus-4-20250514"
+		haiku  = "claude-3-5-haiku-20241022"
+	)
+
+	tests := []struct {
+		name         string
+		replyModel   string // model of the reply being replaced
+		defaultModel string // the user's default, if any
+		requested    string
+		want         string
+	}{
+		{"model of the replaced reply", opus, haiku, "", opus},
+		{"requested model", opus, haiku, sonnet, sonnet},
+		{"user's default when the replaced reply's model is retired", "claude-2.1", haiku, "", haiku},
+		{"user's default when the replaced reply has no model", "", haiku, "", haiku},
+		{"global default", "", "", "", defaultModel},
+	}
+
+	db := dbtest.Open(t)
+	router := chatRouter(newTestChatHandler(db, &FakeProvider{Response: "A new reply"}))
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID := dbtest.CreateUser(t, db, fmt.Sprintf("model%d@example.com", i))
+			conversationID := dbtest.CreateConversation(t, db, userID)
+			if tt.defaultModel != "" {
+				if _, err := db.Exec(`INSERT INTO user_settings (user_id, model) VALUES ($1, $2)`, userID, tt.defaultModel); err != nil {
+					t.Fatalf("saving settings: %v", err)
+				}
+			}
+			if _, err := db.Exec(
+				`UPDATE messages SET model = NULLIF($1, '') WHERE conversation_id = $2 AND role = 'assistant'`,
+				tt.replyModel, conversationID,
+			); err != nil {
+				t.Fatalf("setting reply model: %v", err)
+			}
+
+			var messageID string
+			err := db.QueryRow(`SELECT id FROM messages WHERE conversation_id = $1 AND role = 'user'`, conversationID).Scan(&messageID)
+			if err != nil {
+				t.Fatalf("fetching message: %v", err)
+			}
+
+			body := `{"content":"Hello again"`
+			if tt.requested != "" {
+				body += `,"model":"` + tt.requested + `"`
+			}
+			body += "}"
+			if w := serveAs(router, userID, http.MethodPut, "/api/chat/messages/"+messageID, body); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			var got string
+			err = db.QueryRow(
+				`SELECT model FROM messages WHERE conversation_id = $1 AND role = 'assistant' AND deleted_at IS NULL`,
+				conversationID,
+			).Scan(&got)
+			if err != nil {
+				t.Fatalf("fetching reply: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("model = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayLastResponse(t *testing.T) {
+	db := dbtest.Open(t)
+	userID := dbtest.CreateUser(t, db, "replay@example.com")
+	conversationID := dbtest.CreateConversation(t, db, userID)
+
+	// Spaces and newlines, including runs of them, must survive chunking
+	const stored = "Here is a list:\n\n- one\n-  two\n\nDone. "
+	_, err := db.Exec(
+		`INSERT INTO messages (conversation_id, role, content, created_at)
+		 VALUES ($1, 'user', 'A list please', NOW() + INTERVAL '1 second'),
+			($1, 'assistant', $2, NOW() + INTERVAL '2 seconds')`,
+		conversationID, stored,
+	)
+	if err != nil {
+		t.Fatalf("creating messages: %v", err)
+	}
+
+	router := chatRouter(newTestChatHandler(db, &FakeProvider{}))
+	w := serveAs(router, userID, http.MethodGet, "/api/chat/conversations/"+conversationID+"/replay?delayMs=0", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	events := parseSSE(t, w.Body.String())
+	if len(events) < 3 || events[0].Type != "start" || events[len(events)-1].Type != "end" {
+		t.Fatalf("events = %+v, want start, content and end", events)
+	}
+	if events[0].ConversationID != conversationID {
+		t.Errorf("start conversation = %q, want %q", events[0].ConversationID, conversationID)
+	}
+
+	var replayed strings.Builder
+	for _, event := range events[1 : len(events)-1] {
+		if event.Type != "content" {
+			t.Fatalf("event type = %q, want content", event.Type)
+		}
+		replayed.WriteString(event.Text)
+	}
+	if replayed.String() != stored {
+		t.Errorf("replayed %q, want %q", replayed.String(), stored)
+	}
+	if len(events) == 3 {
+		t.Error("reply was replayed in a single chunk")
+	}
+}
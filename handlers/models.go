@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ModelInfo describes a Claude model clients may request
+type ModelInfo struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	// ContextWindow is the model's context window in tokens
+	ContextWindow int `json:"contextWindow"`
+	// MaxOutputTokens is the most tokens the model can generate in a reply
+	MaxOutputTokens int `json:"maxOutputTokens"`
+	// CostTier is the model's price relative to the others: "low", "medium"
+	// or "high"
+	CostTier string `json:"costTier"`
+}
+
+// supportedModels are the models clients may request, used both to validate
+// requests and to list the choices to clients
+var supportedModels = []ModelInfo{
+	{ID: "claude-sonnet-4-20250514", DisplayName: "Claude Sonnet 4", ContextWindow: 200000, MaxOutputTokens: 64000, CostTier: "medium"},
+	{ID: "claude-opus-4-20250514", DisplayName: "Claude Opus 4", ContextWindow: 200000, MaxOutputTokens: 32000, CostTier: "high"},
+	{ID: "claude-3-5-haiku-20241022", DisplayName: "Claude 3.5 Haiku", ContextWindow: 200000, MaxOutputTokens: 8192, CostTier: "low"},
+}
+
+// lookupModel returns the supported model with the given ID
+func lookupModel(id string) (ModelInfo, bool) {
+	for _, model := range supportedModels {
+		if model.ID == id {
+			return model, true
+		}
+	}
+	return ModelInfo{}, false
+}
+
+// maxReplyTokens returns the most tokens a reply from model may use: the
+// model's own limit, capped at maxTokensCap
+func maxReplyTokens(model string) int {
+	if info, ok := lookupModel(model); ok && info.MaxOutputTokens < maxTokensCap {
+		return info.MaxOutputTokens
+	}
+	return maxTokensCap
+}
+
+func isAllowedModel(model string) bool {
+	_, ok := lookupModel(model)
+	return ok
+}
+
+// GetModels lists the models clients may request, the default first
+func (h *ChatHandler) GetModels(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"models":       supportedModels,
+		"defaultModel": defaultModel,
+	})
+}
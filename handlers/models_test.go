@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/diyorend/dashGPT-backend/config"
+)
+
+func TestMaxReplyTokens(t *testing.T) {
+	// A model whose limit is below the server's cap
+	supportedModels = append(supportedModels, ModelInfo{ID: "test-small", MaxOutputTokens: 1000})
+	t.Cleanup(func() { supportedModels = supportedModels[:len(supportedModels)-1] })
+
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{"claude-sonnet-4-20250514", maxTokensCap},
+		{"claude-3-5-haiku-20241022", 8192},
+		{"test-small", 1000},
+		{"unknown", maxTokensCap},
+	}
+
+	for _, tt := range tests {
+		if got := maxReplyTokens(tt.model); got != tt.want {
+			t.Errorf("maxReplyTokens(%q) = %d, want %d", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	h := NewChatHandler(nil, &FakeProvider{}, nil, config.Chat{MaxMessageLength: 1000, MaxStreamsPerIP: 5, MaxStreams: 500})
+	limits := h.limits()
+
+	if limits.MaxConcurrentStreams != 5 || limits.MaxConcurrentStreamsTotal != 500 {
+		t.Errorf("stream limits = %d per IP, %d total; want 5, 500", limits.MaxConcurrentStreams, limits.MaxConcurrentStreamsTotal)
+	}
+	if len(limits.Models) != len(supportedModels) {
+		t.Fatalf("limits for %d models, want %d", len(limits.Models), len(supportedModels))
+	}
+	for _, m := range limits.Models {
+		if want := maxReplyTokens(m.Model); m.MaxTokens != want {
+			t.Errorf("%s: max tokens = %d, want %d", m.Model, m.MaxTokens, want)
+		}
+	}
+}
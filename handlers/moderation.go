@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+// Moderator screens user messages before they are saved or sent to the model
+type Moderator interface {
+	// Check reports whether text may be sent, and if not, a reason that can
+	// be shown to the user
+	Check(ctx context.Context, text string) (allowed bool, reason string, err error)
+}
+
+// NoopModerator allows every message
+type NoopModerator struct{}
+
+func (NoopModerator) Check(ctx context.Context, text string) (bool, string, error) {
+	return true, "", nil
+}
+
+// KeywordModerator blocks messages matching any of a list of regular
+// expressions. Patterns are case-insensitive.
+type KeywordModerator struct {
+	patterns []*regexp.Regexp
+}
+
+// NewKeywordModerator compiles patterns into a moderator
+func NewKeywordModerator(patterns []string) (*KeywordModerator, error) {
+	m := &KeywordModerator{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid moderation pattern %q: %w", pattern, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+func (m *KeywordModerator) Check(ctx context.Context, text string) (bool, string, error) {
+	for _, re := range m.patterns {
+		if re.MatchString(text) {
+			return false, "Message contains content that isn't allowed", nil
+		}
+	}
+	return true, "", nil
+}
+
+// moderationError returns an error if the moderator blocks a message. Messages
+// can't be screened if the moderator fails, so they are rejected.
+func (h *ChatHandler) moderationError(ctx context.Context, text string) *chatError {
+	allowed, reason, err := h.moderator.Check(ctx, text)
+	if err != nil {
+		slog.Error("Error moderating message", "error", err)
+		return &chatError{status: http.StatusInternalServerError, code: codeInternal, message: "Error checking message"}
+	}
+	if !allowed {
+		return &chatError{status: http.StatusUnprocessableEntity, code: codeContentBlocked, message: reason}
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/diyorend/dashGPT-backend/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetTTL = time.Hour
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// PasswordPolicy is the set of rules new passwords must satisfy
+type PasswordPolicy = config.PasswordPolicy
+
+// ValidatePassword checks a password against the policy, returning an error
+// describing the first rule it fails
+func ValidatePassword(password string, policy PasswordPolicy) error {
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return fmt.Errorf("Password must be at least %d characters", policy.MinLength)
+	}
+
+	var hasLetter, hasDigit bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		}
+	}
+
+	if policy.RequireLetter && !hasLetter {
+		return errors.New("Password must contain at least one letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		return errors.New("Password must contain at least one digit")
+	}
+	return nil
+}
+
+// Bounds for calibrated bcrypt costs. The lower bound keeps hashes from
+// becoming weaker than the library default on slow machines.
+const (
+	minCalibratedBcryptCost = bcrypt.DefaultCost
+	maxCalibratedBcryptCost = 14
+)
+
+// CalibrateBcryptCost benchmarks bcrypt on this machine and returns the highest
+// cost whose hashing time stays within target, clamped to safe bounds. Each
+// cost increment doubles the work, so a single measurement at the minimum
+// cost is enough to extrapolate.
+func CalibrateBcryptCost(target time.Duration) int {
+	start := time.Now()
+	_, _ = bcrypt.GenerateFromPassword([]byte("calibration-password"), minCalibratedBcryptCost)
+	return calibratedBcryptCost(time.Since(start), target)
+}
+
+// calibratedBcryptCost extrapolates from elapsed, the hashing time at the
+// minimum cost, to the highest cost within target
+func calibratedBcryptCost(elapsed, target time.Duration) int {
+	cost := minCalibratedBcryptCost
+	for cost < maxCalibratedBcryptCost && elapsed*2 <= target {
+		cost++
+		elapsed *= 2
+	}
+	return cost
+}
+
+// upgradePasswordHash re-hashes a verified password whose hash has a lower cost
+// than the configured one, so raising the cost applies to existing users as
+// they log in. Failures are logged and leave the old hash in place.
+func (h *AuthHandler) upgradePasswordHash(userID, currentHash, password string) {
+	cost, err := bcrypt.Cost([]byte(currentHash))
+	if err != nil || cost >= h.bcryptCost {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+	if err != nil {
+		slog.Error("Error upgrading password hash", "error", err, "user_id", userID)
+		return
+	}
+
+	// The hash is only replaced if the password hasn't changed in the meantime
+	_, err = h.db.Exec(
+		`UPDATE users SET password = $1 WHERE id = $2 AND password = $3`,
+		string(hashedPassword), userID, currentHash,
+	)
+	if err != nil {
+		slog.Error("Error upgrading password hash", "error", err, "user_id", userID)
+	}
+}
+
+// ForgotPassword emails a single-use password reset link. It responds the same
+// way whether or not the email is registered, to avoid user enumeration.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+	if req.Email == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Email is required")
+		return
+	}
+
+	var userID string
+	err := h.db.QueryRow(`SELECT id FROM users WHERE lower(email) = $1`, req.Email).Scan(&userID)
+	if err == nil {
+		if err := h.sendPasswordReset(userID, req.Email); err != nil {
+			slog.Error("Error sending password reset", "error", err)
+		}
+	} else if err != sql.ErrNoRows {
+		slog.Error("Error looking up user for password reset", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If that email is registered, a password reset link has been sent",
+	})
+}
+
+func (h *AuthHandler) sendPasswordReset(userID, email string) error {
+	token, err := generateRandomToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.Exec(
+		`INSERT INTO password_resets (user_id, token_hash, expires_at)
+		 VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second')`,
+		userID, hashToken(token), int(passwordResetTTL.Seconds()),
+	)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Use the link below to reset your password. It expires in one hour.\n\n%s?token=%s",
+		h.passwordResetURL, token,
+	)
+	return h.mailer.Send(email, "Reset your password", body)
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.Token == "" || req.Password == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Token and password are required")
+		return
+	}
+
+	if err := ValidatePassword(req.Password, h.passwordPolicy); err != nil {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), h.bcryptCost)
+	if err != nil {
+		writeInternalError(w, "Error hashing password", err)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Consume the token so it can't be reused
+	var userID string
+	err = tx.QueryRow(
+		`UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+		 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		 RETURNING user_id`,
+		hashToken(req.Token),
+	).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidToken, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	// Whoever prompted the reset may hold the account's access tokens, so
+	// they are revoked along with the sessions
+	_, err = tx.Exec(
+		`UPDATE users SET password = $1, tokens_valid_after = date_trunc('second', CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP
+		 WHERE id = $2`,
+		string(hashedPassword), userID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error updating password", err)
+		return
+	}
+
+	// Sign out other sessions
+	_, err = tx.Exec(
+		`UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL`,
+		userID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error updating password", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, "Error updating password", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password has been reset",
+	})
+}
+
+// ChangePassword updates the authenticated user's password after re-verifying
+// the current one. Refresh tokens are revoked so other sessions end once their
+// access tokens expire.
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req ChangePasswordRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Current and new password are required")
+		return
+	}
+
+	if err := ValidatePassword(req.NewPassword, h.passwordPolicy); err != nil {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	var currentHash string
+	err := h.db.QueryRow(`SELECT password FROM users WHERE id = $1`, userID).Scan(&currentHash)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(currentHash), []byte(req.CurrentPassword)); err != nil {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidCredentials, "Current password is incorrect")
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), h.bcryptCost)
+	if err != nil {
+		writeInternalError(w, "Error hashing password", err)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`UPDATE users SET password = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`,
+		string(hashedPassword), userID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error updating password", err)
+		return
+	}
+
+	_, err = tx.Exec(
+		`UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL`,
+		userID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error updating password", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, "Error updating password", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCalibratedBcryptCost(t *testing.T) {
+	const ms = time.Millisecond
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		target  time.Duration
+		want    int
+	}{
+		{"target below the minimum cost's time", 50 * ms, 10 * ms, bcrypt.DefaultCost},
+		{"target equal to the minimum cost's time", 50 * ms, 50 * ms, bcrypt.DefaultCost},
+		{"just short of double", 50 * ms, 99 * ms, bcrypt.DefaultCost},
+		{"double", 50 * ms, 100 * ms, bcrypt.DefaultCost + 1},
+		{"eight times", 50 * ms, 400 * ms, bcrypt.DefaultCost + 3},
+		{"capped", 50 * ms, time.Hour, maxCalibratedBcryptCost},
+		{"instant hashing", 0, time.Second, maxCalibratedBcryptCost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calibratedBcryptCost(tt.elapsed, tt.target); got != tt.want {
+				t.Errorf("calibratedBcryptCost(%v, %v) = %d, want %d", tt.elapsed, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalibrateBcryptCostBounds(t *testing.T) {
+	if got := CalibrateBcryptCost(time.Nanosecond); got != bcrypt.DefaultCost {
+		t.Errorf("tiny target: cost = %d, want the default %d", got, bcrypt.DefaultCost)
+	}
+	// Cost 14 already takes around a second per hash
+	if got := CalibrateBcryptCost(24 * time.Hour); got != 14 {
+		t.Errorf("huge target: cost = %d, want the maximum 14", got)
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+)
+
+// decodeJSONBody decodes the request body into v, writing an error and
+// returning false if it is malformed or exceeds the route's size limit
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "Request body too large")
+		return false
+	}
+
+	writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+	return false
+}
+
+// checkMessageLength writes an error and returns false if a message exceeds
+// the configured maximum. The limit is included so clients can show a counter.
+func (h *ChatHandler) checkMessageLength(w http.ResponseWriter, message string) bool {
+	if chatErr := h.messageLengthError(message); chatErr != nil {
+		chatErr.write(w)
+		return false
+	}
+	return true
+}
+
+// messageLengthError returns an error if a message exceeds the configured maximum
+func (h *ChatHandler) messageLengthError(message string) *chatError {
+	if h.maxMessageLength <= 0 || utf8.RuneCountInString(message) <= h.maxMessageLength {
+		return nil
+	}
+
+	return &chatError{
+		status:  http.StatusBadRequest,
+		code:    codeInvalidRequest,
+		message: fmt.Sprintf("Message must be at most %d characters", h.maxMessageLength),
+		fields:  map[string]interface{}{"maxMessageLength": h.maxMessageLength},
+	}
+}
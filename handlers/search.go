@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// SearchResult is the best-matching message in a conversation
+type SearchResult struct {
+	ConversationID string  `json:"conversationId"`
+	Title          string  `json:"title"`
+	MessageID      string  `json:"messageId"`
+	Snippet        string  `json:"snippet"`
+	Rank           float64 `json:"rank"`
+}
+
+// SearchMessages runs a full-text search over the user's messages and returns
+// one result per matching conversation, most relevant first
+func (h *ChatHandler) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "q is required")
+		return
+	}
+
+	limit, offset, ok := parsePagination(r, 20, 100)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and 100 and offset must not be negative")
+		return
+	}
+
+	// The expression must match idx_messages_content_fts for the index to be used
+	rows, err := h.db.Query(
+		`SELECT conversation_id, title, message_id, snippet, rank FROM (
+			SELECT DISTINCT ON (c.id)
+				c.id AS conversation_id, c.title, m.id AS message_id,
+				ts_headline('english', m.content, query, 'MaxWords=30, MinWords=10') AS snippet,
+				ts_rank(to_tsvector('english', m.content), query) AS rank
+			FROM messages m
+			JOIN conversations c ON c.id = m.conversation_id,
+				plainto_tsquery('english', $2) query
+			WHERE c.user_id = $1 AND m.deleted_at IS NULL AND to_tsvector('english', m.content) @@ query
+			ORDER BY c.id, rank DESC
+		 ) best
+		 ORDER BY rank DESC
+		 LIMIT $3 OFFSET $4`,
+		userID, q, limit, offset,
+	)
+	if err != nil {
+		writeInternalError(w, "Error searching messages", err)
+		return
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.ConversationID, &result.Title, &result.MessageID, &result.Snippet, &result.Rank); err != nil {
+			continue
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+	})
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// UserSettings are a user's defaults for new messages and conversations.
+// Unset values fall back to the global defaults.
+type UserSettings struct {
+	Model        *string  `json:"model"`
+	Temperature  *float64 `json:"temperature"`
+	SystemPrompt *string  `json:"systemPrompt"`
+}
+
+// validate returns an error message for invalid settings, or "" if they are
+// valid. Values are checked the same way as when sent with a message.
+func (s UserSettings) validate() string {
+	if s.Model != nil && !isAllowedModel(*s.Model) {
+		return "Unsupported model"
+	}
+	return ConversationSettings{Temperature: s.Temperature, SystemPrompt: s.SystemPrompt}.validate()
+}
+
+// resolveModel returns the requested model, falling back to the user's default
+// and then the global default
+func resolveModel(requested string, defaults UserSettings) string {
+	if requested != "" {
+		return requested
+	}
+	if defaults.Model != nil && isAllowedModel(*defaults.Model) {
+		return *defaults.Model
+	}
+	return defaultModel
+}
+
+// replyModel returns the model for a reply that replaces or continues one
+// generated by previous: the requested model, then previous if it is still
+// supported, then the user's default
+func (h *ChatHandler) replyModel(userID, requested, previous string) (string, error) {
+	if requested == "" && isAllowedModel(previous) {
+		return previous, nil
+	}
+	defaults, err := h.getUserSettings(userID)
+	if err != nil {
+		return "", err
+	}
+	return resolveModel(requested, defaults), nil
+}
+
+// getUserSettings returns the user's defaults, all unset if they have none
+func (h *ChatHandler) getUserSettings(userID string) (UserSettings, error) {
+	var model, systemPrompt sql.NullString
+	var temperature sql.NullFloat64
+	err := h.db.QueryRow(
+		`SELECT model, temperature, system_prompt FROM user_settings WHERE user_id = $1`,
+		userID,
+	).Scan(&model, &temperature, &systemPrompt)
+	if err == sql.ErrNoRows {
+		return UserSettings{}, nil
+	}
+	if err != nil {
+		return UserSettings{}, err
+	}
+
+	var settings UserSettings
+	if model.Valid {
+		settings.Model = &model.String
+	}
+	if temperature.Valid {
+		settings.Temperature = &temperature.Float64
+	}
+	if systemPrompt.Valid {
+		settings.SystemPrompt = &systemPrompt.String
+	}
+	return settings, nil
+}
+
+// GetSettings returns the user's default settings
+func (h *ChatHandler) GetSettings(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	settings, err := h.getUserSettings(userID)
+	if err != nil {
+		writeInternalError(w, "Error fetching settings", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// UpdateSettings replaces the user's default settings. Omitted or null values
+// are cleared, falling back to the global defaults.
+func (h *ChatHandler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req UserSettings
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, msg)
+		return
+	}
+
+	_, err := h.db.Exec(
+		`INSERT INTO user_settings (user_id, model, temperature, system_prompt)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (user_id) DO UPDATE
+		 SET model = EXCLUDED.model, temperature = EXCLUDED.temperature,
+		     system_prompt = EXCLUDED.system_prompt, updated_at = CURRENT_TIMESTAMP`,
+		userID, req.Model, req.Temperature, req.SystemPrompt,
+	)
+	if err != nil {
+		writeInternalError(w, "Error saving settings", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// errGenerationStopped is the cancellation cause of a reply the user stopped
+var errGenerationStopped = errors.New("generation stopped by user")
+
+type streamKey struct {
+	userID         string
+	conversationID string
+}
+
+// activeStream is a reply being streamed, which the user may stop
+type activeStream struct {
+	cancel context.CancelCauseFunc
+}
+
+// streamRegistry tracks the replies being streamed so they can be stopped. If
+// a conversation has several streams at once, the latest one is tracked.
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[streamKey]*activeStream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[streamKey]*activeStream)}
+}
+
+// register tracks a stream until the returned function is called
+func (s *streamRegistry) register(userID, conversationID string, cancel context.CancelCauseFunc) func() {
+	key := streamKey{userID, conversationID}
+	stream := &activeStream{cancel: cancel}
+
+	s.mu.Lock()
+	s.streams[key] = stream
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// A newer stream may have replaced this one
+		if s.streams[key] == stream {
+			delete(s.streams, key)
+		}
+	}
+}
+
+// stop cancels the conversation's stream, returning false if there is none
+func (s *streamRegistry) stop(userID, conversationID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[streamKey{userID, conversationID}]
+	if !ok {
+		return false
+	}
+	stream.cancel(errGenerationStopped)
+	return true
+}
+
+type StopRequest struct {
+	ConversationID string `json:"conversationId"`
+}
+
+// StopGeneration stops the reply being streamed in a conversation. The stream
+// ends normally, keeping the text generated so far.
+func (h *ChatHandler) StopGeneration(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req StopRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.ConversationID == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "conversationId is required")
+		return
+	}
+
+	// Streams are keyed by user, so only the user's own streams can be stopped
+	if !h.streams.stop(userID, req.ConversationID) {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "No reply is being generated")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// streamSink delivers stream events to a client over a particular transport
+type streamSink interface {
+	send(event StreamEvent) error
+	// keepalive tells intermediaries the connection is still in use while no
+	// events are being sent
+	keepalive() error
+}
+
+// sseSink writes stream events as server-sent events. If w can't be flushed,
+// events are buffered and reach the client together once the handler returns.
+type sseSink struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	buffered bool
+}
+
+// newSSESink sets the SSE response headers and returns a sink writing to w
+func newSSESink(w http.ResponseWriter) *sseSink {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	s := &sseSink{w: w, rc: http.NewResponseController(w), buffered: !canFlush(w)}
+	if s.buffered {
+		slog.Warn("Response writer does not support flushing, stream events will be buffered")
+	}
+	return s
+}
+
+// canFlush reports whether writes to w can be flushed to the client. Wrappers
+// are looked through, since they may implement Flush as a no-op when the
+// writer beneath them can't flush.
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = u.Unwrap()
+	}
+	_, ok := w.(http.Flusher)
+	return ok
+}
+
+func (s *sseSink) send(event StreamEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+func (s *sseSink) keepalive() error {
+	// Keepalives only help if they reach the client
+	if s.buffered {
+		return nil
+	}
+	if _, err := fmt.Fprint(s.w, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+func (s *sseSink) flush() {
+	if !s.buffered {
+		_ = s.rc.Flush()
+	}
+}
+
+// chatError is a rejected chat request, reported as an HTTP error or as an
+// error event depending on the transport
+type chatError struct {
+	status  int
+	code    string
+	message string
+	// fields are extra details included alongside the code and message
+	fields map[string]interface{}
+}
+
+func (e *chatError) write(w http.ResponseWriter) {
+	detail := map[string]interface{}{"code": e.code, "message": e.message}
+	for k, v := range e.fields {
+		detail[k] = v
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": detail})
+}
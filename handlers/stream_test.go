@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// plainWriter hides the recorder's Flush method
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+// noopFlushWriter claims to flush but wraps a writer that can't
+type noopFlushWriter struct {
+	w http.ResponseWriter
+}
+
+func (n noopFlushWriter) Header() http.Header         { return n.w.Header() }
+func (n noopFlushWriter) Write(b []byte) (int, error) { return n.w.Write(b) }
+func (n noopFlushWriter) WriteHeader(status int)      { n.w.WriteHeader(status) }
+func (n noopFlushWriter) Flush()                      {}
+func (n noopFlushWriter) Unwrap() http.ResponseWriter { return n.w }
+
+// parseSSE returns the events in an SSE body, failing on anything else
+func parseSSE(t *testing.T, body string) []StreamEvent {
+	t.Helper()
+
+	var events []StreamEvent
+	for _, chunk := range strings.Split(body, "\n\n") {
+		if chunk == "" || strings.HasPrefix(chunk, ":") {
+			continue
+		}
+		data, ok := strings.CutPrefix(chunk, "data: ")
+		if !ok {
+			t.Fatalf("malformed event %q", chunk)
+		}
+		var event StreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("decoding event %q: %v", data, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestSSESink(t *testing.T) {
+	events := []StreamEvent{
+		{Type: "start", ConversationID: "c1"},
+		{Type: "delta", Text: "First line\n\nafter a blank line"},
+		{Type: "delta", Text: `quotes " and unicode ✓`},
+		{Type: "done", StopReason: "end_turn"},
+	}
+
+	tests := []struct {
+		name         string
+		wrap         func(*httptest.ResponseRecorder) http.ResponseWriter
+		wantBuffered bool
+	}{
+		{
+			name:         "flusher",
+			wrap:         func(rec *httptest.ResponseRecorder) http.ResponseWriter { return rec },
+			wantBuffered: false,
+		},
+		{
+			name:         "not a flusher",
+			wrap:         func(rec *httptest.ResponseRecorder) http.ResponseWriter { return plainWriter{rec} },
+			wantBuffered: true,
+		},
+		{
+			name: "wrapper over a writer that can't flush",
+			wrap: func(rec *httptest.ResponseRecorder) http.ResponseWriter {
+				return noopFlushWriter{plainWriter{rec}}
+			},
+			wantBuffered: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			sink := newSSESink(tt.wrap(rec))
+			if sink.buffered != tt.wantBuffered {
+				t.Fatalf("buffered = %t, want %t", sink.buffered, tt.wantBuffered)
+			}
+
+			for i, event := range events {
+				if err := sink.send(event); err != nil {
+					t.Fatalf("sending event: %v", err)
+				}
+				if i == 1 {
+					if err := sink.keepalive(); err != nil {
+						t.Fatalf("sending keepalive: %v", err)
+					}
+				}
+			}
+
+			if rec.Flushed == tt.wantBuffered {
+				t.Errorf("flushed = %t, want %t", rec.Flushed, !tt.wantBuffered)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+				t.Errorf("Content-Type = %q, want text/event-stream", got)
+			}
+			// Keepalives can't reach the client early, so buffered streams skip them
+			if hasKeepalive := strings.Contains(rec.Body.String(), ": keepalive"); hasKeepalive == tt.wantBuffered {
+				t.Errorf("keepalive written = %t, want %t", hasKeepalive, !tt.wantBuffered)
+			}
+			if got := parseSSE(t, rec.Body.String()); !reflect.DeepEqual(got, events) {
+				t.Errorf("events = %+v, want %+v", got, events)
+			}
+		})
+	}
+}
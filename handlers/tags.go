@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// maxTagNameLength matches the tags.name column size
+const maxTagNameLength = 50
+
+type CreateTagRequest struct {
+	Name string `json:"name"`
+}
+
+// GetTags lists the user's tags by name
+func (h *ChatHandler) GetTags(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	rows, err := h.db.Query(
+		`SELECT id, name, created_at FROM tags WHERE user_id = $1 ORDER BY name ASC`,
+		userID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error fetching tags", err)
+		return
+	}
+	defer rows.Close()
+
+	tags := []models.Tag{}
+	for rows.Next() {
+		var tag models.Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.CreatedAt); err != nil {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tags": tags,
+	})
+}
+
+// CreateTag creates a tag. Names are unique per user.
+func (h *ChatHandler) CreateTag(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req CreateTagRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Name is required")
+		return
+	}
+	if utf8.RuneCountInString(name) > maxTagNameLength {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Name must be at most 50 characters")
+		return
+	}
+
+	tag := models.Tag{Name: name}
+	err := h.db.QueryRow(
+		`INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id, created_at`,
+		userID, name,
+	).Scan(&tag.ID, &tag.CreatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		writeJSONError(w, http.StatusConflict, codeConflict, "Tag already exists")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Error creating tag", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tag)
+}
+
+// TagConversation assigns a tag to a conversation. Both must belong to the
+// user; assigning a tag twice has no effect.
+func (h *ChatHandler) TagConversation(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	conversationID := chi.URLParam(r, "id")
+	tagID := chi.URLParam(r, "tagId")
+
+	// The link is only inserted when both belong to the user
+	var owned bool
+	err := h.db.QueryRow(
+		`WITH owned AS (
+			SELECT c.id AS conversation_id, t.id AS tag_id
+			FROM conversations c, tags t
+			WHERE c.id::text = $1 AND c.user_id = $3 AND t.id::text = $2 AND t.user_id = $3
+		 ), inserted AS (
+			INSERT INTO conversation_tags (conversation_id, tag_id)
+			SELECT conversation_id, tag_id FROM owned
+			ON CONFLICT DO NOTHING
+		 )
+		 SELECT EXISTS (SELECT 1 FROM owned)`,
+		conversationID, tagID, userID,
+	).Scan(&owned)
+	if err != nil {
+		writeInternalError(w, "Error tagging conversation", err)
+		return
+	}
+	if !owned {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation or tag not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UntagConversation removes a tag from a conversation owned by the user
+func (h *ChatHandler) UntagConversation(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	conversationID := chi.URLParam(r, "id")
+	tagID := chi.URLParam(r, "tagId")
+
+	result, err := h.db.Exec(
+		`DELETE FROM conversation_tags ct
+		 USING conversations c, tags t
+		 WHERE ct.conversation_id = c.id AND ct.tag_id = t.id
+		   AND c.id::text = $1 AND c.user_id = $3 AND t.id::text = $2 AND t.user_id = $3`,
+		conversationID, tagID, userID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error untagging conversation", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "Conversation is not tagged with this tag")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadConversationTags sets the tags of each conversation, ordered by name
+func (h *ChatHandler) loadConversationTags(conversations []models.Conversation) error {
+	if len(conversations) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(conversations))
+	for i, conv := range conversations {
+		ids[i] = conv.ID
+	}
+
+	rows, err := h.db.Query(
+		`SELECT ct.conversation_id, t.id, t.name, t.created_at
+		 FROM conversation_tags ct
+		 JOIN tags t ON t.id = ct.tag_id
+		 WHERE ct.conversation_id = ANY($1)
+		 ORDER BY t.name ASC`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]models.Tag)
+	for rows.Next() {
+		var tag models.Tag
+		var conversationID string
+		if err := rows.Scan(&conversationID, &tag.ID, &tag.Name, &tag.CreatedAt); err != nil {
+			return err
+		}
+		tags[conversationID] = append(tags[conversationID], tag)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range conversations {
+		conversations[i].Tags = tags[conversations[i].ID]
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpIssuer = "DashGPT"
+	// challengeTokenTTL is how long a user has to enter their code after
+	// logging in with a password
+	challengeTokenTTL = 5 * time.Minute
+	// challengePurpose marks challenge tokens so they can't be used for access
+	challengePurpose = "2fa_challenge"
+)
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	ChallengeToken    string `json:"challengeToken"`
+}
+
+type TwoFactorSetupResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauthUrl"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorValidateRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+}
+
+// EnableTwoFactor generates a new TOTP secret for the user. Two-factor
+// authentication stays off until a code is confirmed with VerifyTwoFactor.
+func (h *AuthHandler) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var email string
+	var enabled bool
+	err := h.db.QueryRow(`SELECT email, totp_enabled FROM users WHERE id = $1`, userID).Scan(&email, &enabled)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	if enabled {
+		writeJSONError(w, http.StatusConflict, codeConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: email,
+	})
+	if err != nil {
+		writeInternalError(w, "Error generating secret", err)
+		return
+	}
+
+	_, err = h.db.Exec(`UPDATE users SET totp_secret = $1 WHERE id = $2`, key.Secret(), userID)
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TwoFactorSetupResponse{
+		Secret:     key.Secret(),
+		OTPAuthURL: key.URL(),
+	})
+}
+
+// VerifyTwoFactor confirms a code from the user's authenticator app and turns
+// on two-factor authentication
+func (h *AuthHandler) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req TwoFactorCodeRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.Code == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Code is required")
+		return
+	}
+
+	var secret sql.NullString
+	err := h.db.QueryRow(`SELECT totp_secret FROM users WHERE id = $1`, userID).Scan(&secret)
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+	if !secret.Valid {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Two-factor authentication has not been set up")
+		return
+	}
+
+	if !totp.Validate(req.Code, secret.String) {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidCredentials, "Invalid code")
+		return
+	}
+
+	_, err = h.db.Exec(`UPDATE users SET totp_enabled = TRUE, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, userID)
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ValidateTwoFactor completes a login by checking a code against the challenge
+// token returned from Login, then issues the access and refresh tokens
+func (h *AuthHandler) ValidateTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req TwoFactorValidateRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if req.ChallengeToken == "" || req.Code == "" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Challenge token and code are required")
+		return
+	}
+
+	userID, ok := h.parseChallengeToken(req.ChallengeToken)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired challenge token")
+		return
+	}
+
+	var user models.User
+	var secret sql.NullString
+	err := h.db.QueryRow(
+		`SELECT id, email, name, role, totp_secret, created_at, updated_at FROM users WHERE id = $1 AND totp_enabled`,
+		userID,
+	).Scan(&user.ID, &user.Email, &user.Name, &user.Role, &secret, &user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired challenge token")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "Database error", err)
+		return
+	}
+
+	if !totp.Validate(req.Code, secret.String) {
+		writeJSONError(w, http.StatusUnauthorized, codeInvalidCredentials, "Invalid code")
+		return
+	}
+
+	token, refreshToken, err := h.issueTokens(user.ID, user.Role)
+	if err != nil {
+		writeInternalError(w, "Error generating token", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         user,
+	})
+}
+
+// generateChallengeToken returns a short-lived token proving the user passed
+// the password check, to be exchanged for real tokens with a valid code
+func (h *AuthHandler) generateChallengeToken(userID string) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"purpose": challengePurpose,
+		"exp":     time.Now().Add(challengeTokenTTL).Unix(),
+		"iat":     time.Now().Unix(),
+	}
+
+	return h.keys.Sign(claims)
+}
+
+func (h *AuthHandler) parseChallengeToken(tokenString string) (string, bool) {
+	claims, err := h.keys.Parse(tokenString)
+	if err != nil {
+		return "", false
+	}
+
+	if claims["purpose"] != challengePurpose {
+		return "", false
+	}
+
+	userID, ok := claims["user_id"].(string)
+	return userID, ok
+}
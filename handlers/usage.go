@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/config"
+)
+
+// checkQuota writes an error and returns false if the user has used up their
+// monthly token quota
+func (h *ChatHandler) checkQuota(w http.ResponseWriter, userID string) bool {
+	if chatErr := h.quotaError(userID); chatErr != nil {
+		chatErr.write(w)
+		return false
+	}
+	return true
+}
+
+// quotaError returns an error if the user has used up their monthly token quota
+func (h *ChatHandler) quotaError(userID string) *chatError {
+	if h.tokenQuota <= 0 {
+		return nil
+	}
+
+	used, err := h.monthlyTokensUsed(userID)
+	if err != nil {
+		return &chatError{status: http.StatusInternalServerError, code: codeInternal, message: "Error checking usage"}
+	}
+	if used >= h.tokenQuota {
+		return &chatError{status: http.StatusTooManyRequests, code: codeQuotaExceeded, message: "Monthly token quota exceeded"}
+	}
+	return nil
+}
+
+// monthlyTokensUsed returns the user's total tokens for the current month
+func (h *ChatHandler) monthlyTokensUsed(userID string) (int64, error) {
+	var used int64
+	err := h.db.QueryRow(
+		`SELECT COALESCE(SUM(input_tokens + output_tokens), 0) FROM user_usage
+		 WHERE user_id = $1 AND month = date_trunc('month', CURRENT_DATE)::date`,
+		userID,
+	).Scan(&used)
+	return used, err
+}
+
+// recordUsage adds a completion's tokens to the user's usage of model in the
+// current month
+func (h *ChatHandler) recordUsage(userID, model string, usage Usage) error {
+	if usage.InputTokens == 0 && usage.OutputTokens == 0 {
+		return nil
+	}
+
+	_, err := h.db.Exec(
+		`INSERT INTO user_usage (user_id, month, model, input_tokens, output_tokens)
+		 VALUES ($1, date_trunc('month', CURRENT_DATE)::date, $2, $3, $4)
+		 ON CONFLICT (user_id, month, model) DO UPDATE SET
+			input_tokens = user_usage.input_tokens + EXCLUDED.input_tokens,
+			output_tokens = user_usage.output_tokens + EXCLUDED.output_tokens`,
+		userID, model, usage.InputTokens, usage.OutputTokens,
+	)
+	return err
+}
+
+// UsageTotals are a user's conversations and messages, and the tokens billed
+// for their requests
+type UsageTotals struct {
+	Conversations int64 `json:"conversations"`
+	Messages      int64 `json:"messages"`
+	InputTokens   int64 `json:"inputTokens"`
+	OutputTokens  int64 `json:"outputTokens"`
+}
+
+// MonthlyUsage is a user's usage in a calendar month, such as "2024-05"
+type MonthlyUsage struct {
+	Month string `json:"month"`
+	UsageTotals
+}
+
+type UsageSummary struct {
+	Totals UsageTotals    `json:"totals"`
+	Months []MonthlyUsage `json:"months,omitempty"`
+}
+
+// GetUsage summarizes the user's usage. With groupBy=month, usage is also
+// broken down by month, most recent first.
+func (h *ChatHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	groupBy := r.URL.Query().Get("groupBy")
+	if groupBy != "" && groupBy != "month" {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "groupBy must be month")
+		return
+	}
+
+	// Conversations and messages count towards the month they were created in
+	rows, err := h.db.Query(
+		`SELECT month, SUM(conversations)::bigint, SUM(messages)::bigint,
+			SUM(input_tokens)::bigint, SUM(output_tokens)::bigint
+		 FROM (
+			SELECT date_trunc('month', created_at)::date AS month,
+				COUNT(*) AS conversations, 0 AS messages, 0 AS input_tokens, 0 AS output_tokens
+			FROM conversations WHERE user_id = $1
+			GROUP BY 1
+			UNION ALL
+			SELECT date_trunc('month', m.created_at)::date, 0, COUNT(*), 0, 0
+			FROM messages m
+			JOIN conversations c ON c.id = m.conversation_id
+			WHERE c.user_id = $1 AND m.deleted_at IS NULL
+			GROUP BY 1
+			UNION ALL
+			SELECT month, 0, 0, input_tokens, output_tokens
+			FROM user_usage WHERE user_id = $1
+		 ) usage
+		 GROUP BY month
+		 ORDER BY month DESC`,
+		userID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error fetching usage", err)
+		return
+	}
+	defer rows.Close()
+
+	var summary UsageSummary
+	for rows.Next() {
+		var month time.Time
+		var usage MonthlyUsage
+		if err := rows.Scan(&month, &usage.Conversations, &usage.Messages, &usage.InputTokens, &usage.OutputTokens); err != nil {
+			writeInternalError(w, "Error fetching usage", err)
+			return
+		}
+		usage.Month = month.Format("2006-01")
+
+		summary.Totals.Conversations += usage.Conversations
+		summary.Totals.Messages += usage.Messages
+		summary.Totals.InputTokens += usage.InputTokens
+		summary.Totals.OutputTokens += usage.OutputTokens
+		if groupBy == "month" {
+			summary.Months = append(summary.Months, usage)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, "Error fetching usage", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// modelUsage is the tokens a user was billed for a model in a month. Usage
+// recorded before models were tracked has no model.
+type modelUsage struct {
+	Model        string
+	InputTokens  int64
+	OutputTokens int64
+}
+
+// UsageProjection extrapolates the user's usage so far this month to the whole
+// month. Costs are in US dollars; tokens of models without a configured price
+// are counted but not priced.
+type UsageProjection struct {
+	Month                 string  `json:"month"`
+	InputTokens           int64   `json:"inputTokens"`
+	OutputTokens          int64   `json:"outputTokens"`
+	CurrentCost           float64 `json:"currentCost"`
+	ProjectedInputTokens  int64   `json:"projectedInputTokens"`
+	ProjectedOutputTokens int64   `json:"projectedOutputTokens"`
+	ProjectedCost         float64 `json:"projectedCost"`
+	DaysRemaining         int     `json:"daysRemaining"`
+}
+
+// projectUsage extrapolates usage so far in the month containing now at the
+// same daily rate. At least a day is assumed to have passed, so usage early on
+// the first day isn't multiplied into an outsized projection.
+func projectUsage(usage []modelUsage, prices map[string]config.ModelPrice, now time.Time) UsageProjection {
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	monthEnd := monthStart.AddDate(0, 1, 0)
+
+	p := UsageProjection{
+		Month:         monthStart.Format("2006-01"),
+		DaysRemaining: int(math.Ceil(monthEnd.Sub(now).Hours() / 24)),
+	}
+	for _, u := range usage {
+		p.InputTokens += u.InputTokens
+		p.OutputTokens += u.OutputTokens
+
+		model := u.Model
+		if model == "" {
+			model = defaultModel
+		}
+		if price, ok := prices[model]; ok {
+			p.CurrentCost += (float64(u.InputTokens)*price.Input + float64(u.OutputTokens)*price.Output) / 1e6
+		}
+	}
+
+	elapsed := math.Max(now.Sub(monthStart).Hours()/24, 1)
+	scale := monthEnd.Sub(monthStart).Hours() / 24 / elapsed
+	p.ProjectedInputTokens = int64(math.Round(float64(p.InputTokens) * scale))
+	p.ProjectedOutputTokens = int64(math.Round(float64(p.OutputTokens) * scale))
+	p.ProjectedCost = p.CurrentCost * scale
+	return p
+}
+
+// GetUsageProjection projects the user's token usage and cost for the current
+// month from their usage so far
+func (h *ChatHandler) GetUsageProjection(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	// The month is taken from the database's clock, as when usage is recorded
+	var now time.Time
+	if err := h.db.QueryRow(`SELECT LOCALTIMESTAMP`).Scan(&now); err != nil {
+		writeInternalError(w, "Error fetching usage", err)
+		return
+	}
+
+	rows, err := h.db.Query(
+		`SELECT model, input_tokens, output_tokens FROM user_usage
+		 WHERE user_id = $1 AND month = date_trunc('month', CURRENT_DATE)::date`,
+		userID,
+	)
+	if err != nil {
+		writeInternalError(w, "Error fetching usage", err)
+		return
+	}
+	defer rows.Close()
+
+	var usage []modelUsage
+	for rows.Next() {
+		var u modelUsage
+		if err := rows.Scan(&u.Model, &u.InputTokens, &u.OutputTokens); err != nil {
+			writeInternalError(w, "Error fetching usage", err)
+			return
+		}
+		usage = append(usage, u)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, "Error fetching usage", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projectUsage(usage, h.prices, now))
+}
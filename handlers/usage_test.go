@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/config"
+)
+
+func TestProjectUsage(t *testing.T) {
+	prices := map[string]config.ModelPrice{
+		defaultModel:                {Input: 3, Output: 15},
+		"claude-3-5-haiku-20241022": {Input: 1, Output: 5},
+	}
+
+	tests := []struct {
+		name  string
+		usage []modelUsage
+		now   time.Time
+		want  UsageProjection
+	}{
+		{
+			name: "mid-month",
+			usage: []modelUsage{
+				{Model: defaultModel, InputTokens: 1_000_000, OutputTokens: 100_000},
+				{Model: "claude-3-5-haiku-20241022", InputTokens: 500_000, OutputTokens: 200_000},
+				{Model: "", InputTokens: 1_000_000},               // recorded before models were, priced as the default
+				{Model: "unpriced-model", InputTokens: 1_000_000}, // counted but not priced
+			},
+			// A third of June has passed
+			now: time.Date(2024, time.June, 11, 0, 0, 0, 0, time.UTC),
+			want: UsageProjection{
+				Month:                 "2024-06",
+				InputTokens:           3_500_000,
+				OutputTokens:          300_000,
+				CurrentCost:           4.5 + 1.5 + 3,
+				ProjectedInputTokens:  10_500_000,
+				ProjectedOutputTokens: 900_000,
+				ProjectedCost:         3 * 9,
+				DaysRemaining:         20,
+			},
+		},
+		{
+			name:  "first day of the month",
+			usage: []modelUsage{{Model: defaultModel, InputTokens: 100_000}},
+			now:   time.Date(2024, time.June, 1, 6, 0, 0, 0, time.UTC),
+			want: UsageProjection{
+				Month:                "2024-06",
+				InputTokens:          100_000,
+				CurrentCost:          0.3,
+				ProjectedInputTokens: 3_000_000,
+				ProjectedCost:        9,
+				DaysRemaining:        30,
+			},
+		},
+		{
+			name: "no usage",
+			now:  time.Date(2024, time.February, 20, 12, 0, 0, 0, time.UTC),
+			want: UsageProjection{Month: "2024-02", DaysRemaining: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := projectUsage(tt.usage, prices, tt.now)
+
+			// Compare costs separately, allowing for rounding
+			for _, cost := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"current cost", got.CurrentCost, tt.want.CurrentCost},
+				{"projected cost", got.ProjectedCost, tt.want.ProjectedCost},
+			} {
+				if math.Abs(cost.got-cost.want) > 1e-9 {
+					t.Errorf("%s = %v, want %v", cost.name, cost.got, cost.want)
+				}
+			}
+			got.CurrentCost, got.ProjectedCost = tt.want.CurrentCost, tt.want.ProjectedCost
+			if got != tt.want {
+				t.Errorf("projectUsage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	// maxWSMessageSize bounds a single request frame, which may carry images
+	maxWSMessageSize = 32 << 20 // 32MB
+	// maxQueuedWSRequests is how many requests a client may send while a reply
+	// is still streaming before the connection is closed
+	maxQueuedWSRequests = 4
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Connections are authenticated with an explicit token rather than
+	// cookies, so other origins can't open one on a user's behalf
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsSink writes stream events as JSON WebSocket frames
+type wsSink struct {
+	conn *websocket.Conn
+}
+
+func (s *wsSink) send(event StreamEvent) error {
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return s.conn.WriteJSON(event)
+}
+
+func (s *wsSink) keepalive() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// ChatWebSocket streams chat replies over a WebSocket for clients that can't
+// use SSE. Each text frame is a ChatRequest, answered with the same events
+// SendMessage sends, one per frame. Requests are handled in order.
+func (h *ChatHandler) ChatWebSocket(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == "" {
+		writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Upgrade writes its own error response on failure
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxWSMessageSize)
+
+	// Read in the background so a closed connection cancels the reply being
+	// streamed, as a disconnect does for SSE
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	requests := make(chan []byte, maxQueuedWSRequests)
+	go func() {
+		defer cancel()
+		defer close(requests)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case requests <- data:
+			default:
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Too many pending requests"),
+					time.Now().Add(wsWriteTimeout))
+				return
+			}
+		}
+	}()
+
+	sink := &wsSink{conn: conn}
+	for data := range requests {
+		if ctx.Err() != nil {
+			return
+		}
+
+		var req ChatRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			sink.send(StreamEvent{Type: "error", Text: "Invalid request body", RequestID: chimiddleware.GetReqID(ctx)})
+			continue
+		}
+
+		reply, chatErr := h.prepareReply(ctx, userID, req)
+		if chatErr != nil {
+			sink.send(StreamEvent{Type: "error", Text: chatErr.message, RequestID: chimiddleware.GetReqID(ctx)})
+			continue
+		}
+		h.streamReply(ctx, sink, reply)
+	}
+}
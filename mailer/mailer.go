@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+)
+
+// Mailer sends plain-text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// LogMailer writes emails to the log instead of sending them, for local development
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	slog.Info("Email", "to", to, "subject", subject, "body", body)
+	return nil
+}
+
+// SMTPMailer sends emails through an SMTP server using PLAIN auth
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.From, to, subject, body)
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
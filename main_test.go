@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/config"
+	"github.com/diyorend/dashGPT-backend/dbtest"
+	"github.com/diyorend/dashGPT-backend/handlers"
+	"github.com/diyorend/dashGPT-backend/mailer"
+	"github.com/diyorend/dashGPT-backend/middleware"
+	"github.com/diyorend/dashGPT-backend/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer serves the full router with the default configuration, chat
+// replies from a fake provider and a signed-up user, returning the user's
+// access token
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+
+	db := dbtest.Open(t)
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("CLAUDE_API_KEY", "unused")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("loading configuration: %v", err)
+	}
+
+	keys := tokens.NewHMACKeySet(cfg.JWT.Secret)
+	h := routeHandlers{
+		auth:      handlers.NewAuthHandler(db, keys, mailer.LogMailer{}, cfg.Auth),
+		dashboard: handlers.NewDashboardHandler(db),
+		admin:     handlers.NewAdminHandler(db),
+		chat:      handlers.NewChatHandler(db, &handlers.FakeProvider{Response: "Hello there"}, nil, cfg.Chat),
+	}
+	srv := httptest.NewServer(newRouter(cfg, keys, h, middleware.MemoryRateLimiter{}))
+	t.Cleanup(srv.Close)
+
+	userID := dbtest.CreateUser(t, db, "compress@example.com")
+	dbtest.CreateConversation(t, db, userID)
+	token, err := keys.Sign(jwt.MapClaims{
+		"jti":     "compress-test",
+		"user_id": userID,
+		"role":    "user",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+		"iat":     time.Now().Unix(),
+	})
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return srv, token
+}
+
+func TestResponseCompression(t *testing.T) {
+	srv, token := newTestServer(t)
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		contentType  string
+		wantCompress bool
+	}{
+		{"chart data", http.MethodGet, "/api/dashboard/charts", "", "application/json", true},
+		{"chart CSV export", http.MethodGet, "/api/dashboard/charts/export?format=csv", "", "text/csv", true},
+		{"chat stream", http.MethodPost, "/api/chat", `{"message":"Hi"}`, "text/event-stream", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", "Bearer "+token)
+			r.Header.Set("Content-Type", "application/json")
+			// Set explicitly, so the client leaves the response encoded
+			r.Header.Set("Accept-Encoding", "gzip")
+
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.contentType)
+			}
+			compressed := resp.Header.Get("Content-Encoding") == "gzip"
+			if compressed != tt.wantCompress {
+				t.Fatalf("compressed = %t, want %t", compressed, tt.wantCompress)
+			}
+			if !compressed && tt.contentType == "text/event-stream" && !strings.Contains(string(body), "Hello there") {
+				t.Errorf("stream doesn't contain the reply: %q", body)
+			}
+		})
+	}
+
+	t.Run("chat WebSocket", func(t *testing.T) {
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/chat/ws?token=" + token
+		conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Accept-Encoding": {"gzip"}})
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		defer conn.Close()
+
+		if got := resp.Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("handshake Content-Encoding = %q, want none", got)
+		}
+
+		if err := conn.WriteJSON(handlers.ChatRequest{Message: "Hi"}); err != nil {
+			t.Fatalf("sending message: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		var event handlers.StreamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Errorf("event isn't plain JSON: %v; frame: %q", err, data)
+		}
+	})
+}
+
+func TestLogLevel(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("CLAUDE_API_KEY", "unused")
+
+	tests := []struct {
+		level   string
+		want    []string // messages logged
+		wantErr bool
+	}{
+		{level: "", want: []string{"info", "warn"}},
+		{level: "debug", want: []string{"debug", "info", "warn"}},
+		{level: "info", want: []string{"info", "warn"}},
+		{level: "WARN", want: []string{"warn"}},
+		{level: "verbose", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		name := tt.level
+		if name == "" {
+			name = "unset"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", tt.level)
+			cfg, err := config.Load()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "LOG_LEVEL") {
+					t.Fatalf("error = %v, want one naming LOG_LEVEL", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loading configuration: %v", err)
+			}
+
+			var buf bytes.Buffer
+			logger := slog.New(newLogHandler(&buf, cfg.LogLevel))
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+
+			var got []string
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var record struct{ Msg string }
+				if err := dec.Decode(&record); err != nil {
+					t.Fatalf("decoding log record: %v", err)
+				}
+				got = append(got, record.Msg)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
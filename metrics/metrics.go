@@ -0,0 +1,47 @@
+// Package metrics defines the Prometheus metrics exported at /metrics. They
+// are registered with the default registry.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// HTTPRequests counts completed requests by route pattern, so paths with
+	// IDs don't each get their own series
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// ActiveStreams is the number of open chat streams across transports
+	ActiveStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_active_streams",
+		Help: "Chat streams currently open.",
+	})
+
+	ChatTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_tokens_total",
+		Help: "Tokens billed for chat replies by model and direction (input or output).",
+	}, []string{"model", "direction"})
+
+	// ClaudeRequestDuration covers a whole request, including reading the
+	// stream for streamed completions
+	ClaudeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "claude_request_duration_seconds",
+		Help:    "Claude API request duration by model and whether the request streamed.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 20, 40, 60, 120},
+	}, []string{"model", "stream"})
+
+	ClaudeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "claude_errors_total",
+		Help: "Failed Claude API requests by model.",
+	}, []string{"model"})
+)
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes used by middleware, from the same set as the handlers' error
+// responses
+const (
+	codeUnauthorized    = "unauthorized"
+	codeInvalidToken    = "invalid_token"
+	codeForbidden       = "forbidden"
+	codePayloadTooLarge = "payload_too_large"
+	codeRateLimited     = "rate_limited"
+	codeInternal        = "internal_error"
+)
+
+// writeJSONError writes an error response in the same shape as the handlers:
+// {"error": {"code": "...", "message": "..."}}
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
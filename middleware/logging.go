@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+const logInfoKey contextKey = "logInfo"
+
+// logInfo collects request details that are only known further down the
+// middleware chain, such as the authenticated user
+type logInfo struct {
+	userID string
+}
+
+// statusRecorder captures the response status for logging. It forwards Flush
+// and Hijack so streaming and WebSocket handlers keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// RequestLogger logs each request as a structured entry once it completes. It
+// must run after chi's RequestID middleware.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &logInfo{}
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), logInfoKey, info)))
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		attrs := []any{
+			"request_id", chimiddleware.GetReqID(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"latency_ms", time.Since(start).Milliseconds(),
+		}
+		if info.userID != "" {
+			attrs = append(attrs, "user_id", info.userID)
+		}
+		slog.Info("request", attrs...)
+	})
+}
+
+// setLogUserID records the authenticated user for the request log entry
+func setLogUserID(r *http.Request, userID string) {
+	if info, ok := r.Context().Value(logInfoKey).(*logInfo); ok {
+		info.userID = userID
+	}
+}
@@ -2,126 +2,354 @@ package middleware
 
 import (
 	"context"
-	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/diyorend/dashGPT-backend/metrics"
+	"github.com/diyorend/dashGPT-backend/tokens"
 )
 
 type contextKey string
 
-const UserIDKey contextKey = "userID"
+const (
+	UserIDKey  contextKey = "userID"
+	TokenIDKey contextKey = "tokenID"
+	RoleKey    contextKey = "role"
+)
+
+// TokenRevocationChecker reports whether an access token has been revoked,
+// either on its own or along with every token issued to its user
+type TokenRevocationChecker interface {
+	IsTokenRevoked(userID, jti string, issuedAt time.Time) (bool, error)
+}
+
+// TokenFromQuery lets clients that cannot set headers, such as browser
+// WebSockets, pass the access token in the token query param. It must run
+// before AuthMiddleware and only be applied to routes that need it, since
+// URLs are more likely than headers to end up in logs.
+func TokenFromQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-// AuthMiddleware validates JWT tokens
-func AuthMiddleware(jwtSecret string) func(http.Handler) http.Handler {
+// AuthMiddleware validates JWT tokens, rejecting those revoked through logout
+func AuthMiddleware(keys *tokens.KeySet, revocations TokenRevocationChecker) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
-				http.Error(w, `{"error":"Authorization header required"}`, http.StatusUnauthorized)
+				writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "Authorization header required")
 				return
 			}
 
 			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 			if tokenString == authHeader {
-				http.Error(w, `{"error":"Invalid authorization format"}`, http.StatusUnauthorized)
+				writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid authorization format")
 				return
 			}
 
-			token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-				}
-				return []byte(jwtSecret), nil
-			})
-
-			if err != nil || !token.Valid {
-				http.Error(w, `{"error":"Invalid or expired token"}`, http.StatusUnauthorized)
+			claims, err := keys.Parse(tokenString)
+			if err != nil {
+				writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired token")
 				return
 			}
 
-			claims, ok := token.Claims.(jwt.MapClaims)
-			if !ok {
-				http.Error(w, `{"error":"Invalid token claims"}`, http.StatusUnauthorized)
+			// Purpose-specific tokens, such as two-factor challenges, don't grant access
+			if _, ok := claims["purpose"]; ok {
+				writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired token")
 				return
 			}
 
 			userID, ok := claims["user_id"].(string)
 			if !ok {
-				http.Error(w, `{"error":"Invalid user ID in token"}`, http.StatusUnauthorized)
+				writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Invalid user ID in token")
+				return
+			}
+
+			// Tokens issued before logout support have no ID and can't be
+			// revoked on their own, but are still revoked along with their
+			// user's other tokens
+			jti, _ := claims["jti"].(string)
+			var issuedAt time.Time
+			if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+				issuedAt = iat.Time
+			}
+			revoked, err := revocations.IsTokenRevoked(userID, jti, issuedAt)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, codeInternal, "Error validating token")
+				return
+			}
+			if revoked {
+				writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "Token has been revoked")
 				return
 			}
 
-			// Add user ID to context
+			// Tokens issued before roles existed belong to regular users
+			role, _ := claims["role"].(string)
+			if role == "" {
+				role = "user"
+			}
+
+			// Add user ID, token ID and role to context
+			setLogUserID(r, userID)
 			ctx := context.WithValue(r.Context(), UserIDKey, userID)
+			ctx = context.WithValue(ctx, TokenIDKey, jti)
+			ctx = context.WithValue(ctx, RoleKey, role)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-// RateLimiter implements a simple in-memory rate limiter
-type visitor struct {
-	lastSeen time.Time
-	count    int
+// RequireRole rejects requests whose token does not carry the given role. It
+// must run after AuthMiddleware.
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if userRole, _ := r.Context().Value(RoleKey).(string); userRole != role {
+				writeJSONError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-var (
-	visitors = make(map[string]*visitor)
-	mu       sync.RWMutex
-)
+// Limiter builds rate limiting middleware, so the in-memory and Redis
+// limiters can be swapped. Limits under different scopes are counted
+// separately.
+type Limiter interface {
+	// Limit limits requests per client IP, like RateLimiter
+	Limit(scope string, requestsPerWindow int, window time.Duration) func(http.Handler) http.Handler
+	// LimitUser limits requests per authenticated user, like UserRateLimiter
+	LimitUser(scope string, requestsPerWindow int, window time.Duration) func(http.Handler) http.Handler
+}
+
+// MemoryRateLimiter is a Limiter tracking requests in memory. Each middleware
+// it returns keeps its own buckets, so scopes need no separate keys.
+type MemoryRateLimiter struct{}
+
+func (MemoryRateLimiter) Limit(scope string, requestsPerWindow int, window time.Duration) func(http.Handler) http.Handler {
+	return RateLimiter(requestsPerWindow, window)
+}
 
+func (MemoryRateLimiter) LimitUser(scope string, requestsPerWindow int, window time.Duration) func(http.Handler) http.Handler {
+	return UserRateLimiter(requestsPerWindow, window)
+}
+
+// RateLimiter limits requests per client IP
 func RateLimiter(requestsPerWindow int, window time.Duration) func(http.Handler) http.Handler {
-	// Cleanup old visitors periodically
+	return newRateLimiter(requestsPerWindow, window, clientIP)
+}
+
+// UserRateLimiter limits requests per authenticated user, so users sharing an
+// IP don't share a limit. It must run after AuthMiddleware; requests without a
+// user are limited by IP.
+func UserRateLimiter(requestsPerWindow int, window time.Duration) func(http.Handler) http.Handler {
+	return newRateLimiter(requestsPerWindow, window, userOrIPKey)
+}
+
+// visitor is a token bucket holding the requests a client may still make.
+// Tokens refill continuously, so the rate stays smooth across what would be
+// window boundaries in a fixed-window limiter.
+type visitor struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// tokenBuckets holds a visitor per client key. Buckets hold up to capacity
+// tokens and refill at refillRate tokens per second.
+type tokenBuckets struct {
+	mu         sync.Mutex
+	visitors   map[string]*visitor
+	capacity   float64
+	refillRate float64
+	window     time.Duration
+}
+
+func newTokenBuckets(requestsPerWindow int, window time.Duration) *tokenBuckets {
+	capacity := float64(requestsPerWindow)
+	return &tokenBuckets{
+		visitors:   make(map[string]*visitor),
+		capacity:   capacity,
+		refillRate: capacity / window.Seconds(),
+		window:     window,
+	}
+}
+
+// take spends a token from key's bucket at now if one is available. It
+// returns the whole tokens left, when the bucket will be full again and when
+// the next token will be available.
+func (b *tokenBuckets) take(key string, now time.Time) (allowed bool, remaining int, reset, retryAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v, exists := b.visitors[key]
+	if !exists {
+		v = &visitor{tokens: b.capacity, lastRefill: now}
+		b.visitors[key] = v
+	}
+
+	// Refill for the time elapsed since the last request
+	v.tokens = math.Min(b.capacity, v.tokens+now.Sub(v.lastRefill).Seconds()*b.refillRate)
+	v.lastRefill = now
+
+	allowed = v.tokens >= 1
+	if allowed {
+		v.tokens--
+	}
+	remaining = int(v.tokens)
+	reset = now.Add(secondsToDuration((b.capacity - v.tokens) / b.refillRate))
+	retryAt = now.Add(secondsToDuration((1 - v.tokens) / b.refillRate))
+	return allowed, remaining, reset, retryAt
+}
+
+// cleanup forgets visitors idle for longer than a window, whose buckets have
+// refilled
+func (b *tokenBuckets) cleanup(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, v := range b.visitors {
+		if now.Sub(v.lastRefill) > b.window {
+			delete(b.visitors, key)
+		}
+	}
+}
+
+// newRateLimiter implements an in-memory token bucket rate limiter. Buckets
+// hold up to requestsPerWindow tokens and refill at requestsPerWindow per window.
+func newRateLimiter(requestsPerWindow int, window time.Duration, keyFunc func(*http.Request) string) func(http.Handler) http.Handler {
+	buckets := newTokenBuckets(requestsPerWindow, window)
+
 	go func() {
 		ticker := time.NewTicker(time.Minute)
 		defer ticker.Stop()
-		for range ticker.C {
-			mu.Lock()
-			for ip, v := range visitors {
-				if time.Since(v.lastSeen) > window {
-					delete(visitors, ip)
-				}
-			}
-			mu.Unlock()
+		for now := range ticker.C {
+			buckets.cleanup(now)
 		}
 	}()
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := r.RemoteAddr
-
-			mu.Lock()
-			v, exists := visitors[ip]
-			if !exists {
-				visitors[ip] = &visitor{lastSeen: time.Now(), count: 1}
-				mu.Unlock()
-				next.ServeHTTP(w, r)
+			allowed, remaining, reset, retryAt := buckets.take(keyFunc(r), time.Now())
+			if !writeRateLimit(w, requestsPerWindow, remaining, reset, retryAt, allowed) {
 				return
 			}
 
-			if time.Since(v.lastSeen) > window {
-				v.count = 1
-				v.lastSeen = time.Now()
-				mu.Unlock()
-				next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// writeRateLimit sets the rate limit headers so clients can pace themselves
+// and, if the request is not allowed, rejects it with a Retry-After of retryAt.
+// It reports whether the request may proceed.
+func writeRateLimit(w http.ResponseWriter, limit, remaining int, reset, retryAt time.Time, allowed bool) bool {
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+	if allowed {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(time.Until(retryAt).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "Rate limit exceeded. Please try again later.")
+	return false
+}
+
+// StreamLimiter caps the number of concurrent long-lived streaming connections
+// per client IP and across all clients. A limit of 0 disables that cap.
+func StreamLimiter(maxPerIP, maxTotal int) func(http.Handler) http.Handler {
+	var (
+		streamsMu sync.Mutex
+		perIP     = make(map[string]int)
+		total     int
+	)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+
+			streamsMu.Lock()
+			if (maxPerIP > 0 && perIP[ip] >= maxPerIP) || (maxTotal > 0 && total >= maxTotal) {
+				streamsMu.Unlock()
+				writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "Too many concurrent streams. Please try again later.")
 				return
 			}
+			perIP[ip]++
+			total++
+			streamsMu.Unlock()
+			metrics.ActiveStreams.Inc()
+
+			// Release the slot once the stream ends or the client disconnects
+			defer func() {
+				streamsMu.Lock()
+				perIP[ip]--
+				if perIP[ip] <= 0 {
+					delete(perIP, ip)
+				}
+				total--
+				streamsMu.Unlock()
+				metrics.ActiveStreams.Dec()
+			}()
 
-			if v.count >= requestsPerWindow {
-				mu.Unlock()
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte(`{"error":"Rate limit exceeded. Please try again later."}`))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// userOrIPKey keys rate limits on the authenticated user, falling back to the
+// client IP
+func userOrIPKey(r *http.Request) string {
+	if userID, ok := r.Context().Value(UserIDKey).(string); ok && userID != "" {
+		return "user:" + userID
+	}
+	return clientIP(r)
+}
+
+// clientIP returns the client address without the source port, so it does not
+// change with every connection. chi's RealIP middleware has already replaced
+// RemoteAddr with any forwarded address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// MaxBodySize rejects request bodies larger than limit bytes with 413. Bodies
+// without a declared length are cut off at the limit while being read.
+func MaxBodySize(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "Request body too large")
 				return
 			}
 
-			v.count++
-			v.lastSeen = time.Now()
-			mu.Unlock()
-
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bucketStep is a request from key made at an offset from the start of a test
+type bucketStep struct {
+	at            time.Duration
+	key           string
+	wantAllowed   bool
+	wantRemaining int
+}
+
+// tokenBucketTests are run against each rate limiter backend with buckets of
+// 2 requests per second, which refill a token every 500ms
+var tokenBucketTests = []struct {
+	name  string
+	steps []bucketStep
+}{
+	{
+		name: "burst then refill",
+		steps: []bucketStep{
+			{0, "a", true, 1},
+			{0, "a", true, 0},
+			{0, "a", false, 0},
+			{250 * time.Millisecond, "a", false, 0},
+			{500 * time.Millisecond, "a", true, 0},
+			{500 * time.Millisecond, "a", false, 0},
+		},
+	},
+	{
+		name: "refill stops at capacity",
+		steps: []bucketStep{
+			{0, "a", true, 1},
+			{0, "a", true, 0},
+			{time.Minute, "a", true, 1},
+			{time.Minute, "a", true, 0},
+			{time.Minute, "a", false, 0},
+		},
+	},
+	{
+		name: "keys are isolated",
+		steps: []bucketStep{
+			{0, "a", true, 1},
+			{0, "a", true, 0},
+			{0, "a", false, 0},
+			{0, "b", true, 1},
+			{0, "b", true, 0},
+			{0, "b", false, 0},
+		},
+	},
+}
+
+func TestTokenBuckets(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tokenBucketTests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets := newTokenBuckets(2, time.Second)
+			for i, s := range tt.steps {
+				allowed, remaining, _, _ := buckets.take(s.key, start.Add(s.at))
+				if allowed != s.wantAllowed || remaining != s.wantRemaining {
+					t.Fatalf("step %d (%s at %s): allowed = %t, remaining = %d; want %t, %d",
+						i, s.key, s.at, allowed, remaining, s.wantAllowed, s.wantRemaining)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketsResetAndRetry(t *testing.T) {
+	buckets := newTokenBuckets(2, time.Second)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	buckets.take("a", now)
+	buckets.take("a", now)
+	allowed, _, reset, retryAt := buckets.take("a", now)
+	if allowed {
+		t.Fatal("request over the limit was allowed")
+	}
+	if want := now.Add(time.Second); !reset.Equal(want) {
+		t.Errorf("reset = %s, want %s", reset, want)
+	}
+	if want := now.Add(500 * time.Millisecond); !retryAt.Equal(want) {
+		t.Errorf("retry at = %s, want %s", retryAt, want)
+	}
+}
+
+func TestTokenBucketsCleanup(t *testing.T) {
+	buckets := newTokenBuckets(2, time.Second)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	buckets.take("idle", start)
+	buckets.take("active", start.Add(800*time.Millisecond))
+	buckets.cleanup(start.Add(1500 * time.Millisecond))
+
+	if _, ok := buckets.visitors["idle"]; ok {
+		t.Error("idle visitor was not cleaned up")
+	}
+	if _, ok := buckets.visitors["active"]; !ok {
+		t.Error("active visitor was cleaned up")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limited := RateLimiter(2, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		limited.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		remoteAddr    string
+		wantStatus    int
+		wantRemaining string
+	}{
+		{"192.0.2.1:1000", http.StatusOK, "1"},
+		// A new connection from the same client shares its bucket
+		{"192.0.2.1:1001", http.StatusOK, "0"},
+		{"192.0.2.1:1002", http.StatusTooManyRequests, "0"},
+		{"192.0.2.2:1000", http.StatusOK, "1"},
+	}
+
+	for i, tt := range tests {
+		w := request(tt.remoteAddr)
+		if w.Code != tt.wantStatus {
+			t.Fatalf("request %d from %s: status = %d, want %d", i, tt.remoteAddr, w.Code, tt.wantStatus)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != tt.wantRemaining {
+			t.Errorf("request %d from %s: X-RateLimit-Remaining = %q, want %q", i, tt.remoteAddr, got, tt.wantRemaining)
+		}
+		if got := w.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d from %s: X-RateLimit-Limit = %q, want %q", i, tt.remoteAddr, got, "2")
+		}
+		if tt.wantStatus == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d from %s: missing Retry-After", i, tt.remoteAddr)
+		}
+	}
+}
+
+func TestStreamLimiter(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxPerIP     int
+		maxTotal     int
+		open         []string
+		next         string
+		wantRejected bool
+	}{
+		{"per-IP cap", 1, 0, []string{"192.0.2.1"}, "192.0.2.1", true},
+		{"per-IP cap leaves other IPs", 1, 0, []string{"192.0.2.1"}, "192.0.2.2", false},
+		{"global cap", 0, 2, []string{"192.0.2.1", "192.0.2.2"}, "192.0.2.3", true},
+		{"under both caps", 2, 3, []string{"192.0.2.1", "192.0.2.2"}, "192.0.2.1", false},
+		{"no caps", 0, 0, []string{"192.0.2.1", "192.0.2.1", "192.0.2.1"}, "192.0.2.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{}, len(tt.open)+2)
+			release := make(chan struct{})
+			limited := StreamLimiter(tt.maxPerIP, tt.maxTotal)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+			}))
+
+			stream := func(ip string) int {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = ip + ":1234"
+				w := httptest.NewRecorder()
+				limited.ServeHTTP(w, r)
+				return w.Code
+			}
+
+			var wg sync.WaitGroup
+			for _, ip := range tt.open {
+				wg.Add(1)
+				go func(ip string) {
+					defer wg.Done()
+					stream(ip)
+				}(ip)
+				<-started
+			}
+
+			done := make(chan int, 1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				done <- stream(tt.next)
+			}()
+
+			select {
+			case <-started:
+				if tt.wantRejected {
+					t.Error("stream over the cap was allowed")
+				}
+			case code := <-done:
+				if !tt.wantRejected {
+					t.Errorf("stream was rejected with status %d", code)
+				} else if code != http.StatusTooManyRequests {
+					t.Errorf("status = %d, want %d", code, http.StatusTooManyRequests)
+				}
+			}
+
+			// Ending the streams frees their slots
+			close(release)
+			wg.Wait()
+			if code := stream(tt.next); code != http.StatusOK {
+				t.Errorf("stream after others ended: status = %d, want %d", code, http.StatusOK)
+			}
+		})
+	}
+}
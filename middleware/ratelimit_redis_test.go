@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisLimiter returns a limiter backed by an in-process Redis
+func newTestRedisLimiter(t *testing.T) (*RedisRateLimiter, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisRateLimiter(client), mr
+}
+
+// limitedStatus sends a request from remoteAddr through handler, returning the status
+func limitedStatus(handler http.Handler, remoteAddr string) int {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestRedisRateLimiterScopes(t *testing.T) {
+	limiter, _ := newTestRedisLimiter(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	account := limiter.Limit("account", 2, time.Minute)(ok)
+	settings := limiter.Limit("settings", 2, time.Minute)(ok)
+	// Another instance limiting the same scope shares its counts
+	accountElsewhere := limiter.Limit("account", 2, time.Minute)(ok)
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		remoteAddr string
+		wantStatus int
+	}{
+		{"account", account, "192.0.2.1:1000", http.StatusOK},
+		{"account", account, "192.0.2.1:1000", http.StatusOK},
+		{"account over the limit", account, "192.0.2.1:1000", http.StatusTooManyRequests},
+		{"same scope elsewhere", accountElsewhere, "192.0.2.1:1000", http.StatusTooManyRequests},
+		{"another client", account, "192.0.2.2:1000", http.StatusOK},
+		{"another scope", settings, "192.0.2.1:1000", http.StatusOK},
+		{"another scope", settings, "192.0.2.1:1000", http.StatusOK},
+		{"another scope over the limit", settings, "192.0.2.1:1000", http.StatusTooManyRequests},
+	}
+
+	for i, tt := range tests {
+		if got := limitedStatus(tt.handler, tt.remoteAddr); got != tt.wantStatus {
+			t.Fatalf("request %d (%s): status = %d, want %d", i, tt.name, got, tt.wantStatus)
+		}
+	}
+}
+
+func TestRedisRateLimiterBuckets(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tokenBucketTests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, mr := newTestRedisLimiter(t)
+			limited := limiter.Limit("test", 2, time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			for i, s := range tt.steps {
+				mr.SetTime(start.Add(s.at))
+
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = s.key + ":1000"
+				w := httptest.NewRecorder()
+				limited.ServeHTTP(w, r)
+
+				allowed := w.Code == http.StatusOK
+				remaining := w.Header().Get("X-RateLimit-Remaining")
+				if allowed != s.wantAllowed || remaining != strconv.Itoa(s.wantRemaining) {
+					t.Fatalf("step %d (%s at %s): allowed = %t, remaining = %s; want %t, %d",
+						i, s.key, s.at, allowed, remaining, s.wantAllowed, s.wantRemaining)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisRateLimiterExpiresIdleBuckets(t *testing.T) {
+	limiter, mr := newTestRedisLimiter(t)
+	limited := limiter.Limit("test", 2, time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	limitedStatus(limited, "192.0.2.1:1000")
+	if len(mr.Keys()) != 1 {
+		t.Fatalf("keys = %q, want one bucket", mr.Keys())
+	}
+
+	mr.FastForward(time.Second)
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("keys = %q, want the idle bucket expired", keys)
+	}
+}
+
+func TestRedisRateLimiterFailsOpen(t *testing.T) {
+	limiter, mr := newTestRedisLimiter(t)
+	limited := limiter.Limit("account", 1, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	mr.Close()
+	for i := 0; i < 3; i++ {
+		if got := limitedStatus(limited, "192.0.2.1:1000"); got != http.StatusOK {
+			t.Fatalf("request %d with Redis down: status = %d, want %d", i, got, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package models
+
+// MigrationCount is the number of migrations RunMigrations applies
+var MigrationCount = len(migrations)
+
+// MigrationLockID is exported for tests holding the migration lock
+const MigrationLockID = migrationLockID
@@ -0,0 +1,375 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a versioned schema change. Once released, a migration must not
+// be edited; change the schema by appending a new one.
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations are applied in order. The early ones were written to be
+// idempotent because they predate version tracking and may already have run.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users, conversations and messages",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS users (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				email VARCHAR(255) UNIQUE NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				password VARCHAR(255) NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS conversations (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				title VARCHAR(500) DEFAULT 'New Conversation',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS messages (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+				role VARCHAR(50) NOT NULL,
+				content TEXT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_conversations_user_id ON conversations(user_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "add message pinning",
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_pinned BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version: 3,
+		name:    "record the model for each message",
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS model VARCHAR(100)`,
+		},
+	},
+	{
+		version: 4,
+		name:    "add per-conversation generation settings",
+		statements: []string{
+			`ALTER TABLE conversations ADD COLUMN IF NOT EXISTS max_tokens INTEGER`,
+			`ALTER TABLE conversations ADD COLUMN IF NOT EXISTS temperature DOUBLE PRECISION`,
+			`ALTER TABLE conversations ADD COLUMN IF NOT EXISTS system_prompt TEXT`,
+		},
+	},
+	{
+		version: 5,
+		name:    "track monthly token usage",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS user_usage (
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				month DATE NOT NULL,
+				input_tokens BIGINT NOT NULL DEFAULT 0,
+				output_tokens BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, month)
+			)`,
+		},
+	},
+	{
+		version: 6,
+		name:    "add refresh tokens",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS refresh_tokens (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				token_hash VARCHAR(64) UNIQUE NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				used_at TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id)`,
+		},
+	},
+	{
+		version: 7,
+		name:    "add password resets",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS password_resets (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				token_hash VARCHAR(64) UNIQUE NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				used_at TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+		},
+	},
+	{
+		version: 8,
+		name:    "index message content for full-text search",
+		statements: []string{
+			`CREATE INDEX IF NOT EXISTS idx_messages_content_fts ON messages USING GIN (to_tsvector('english', content))`,
+		},
+	},
+	{
+		version: 9,
+		name:    "add revoked access tokens",
+		statements: []string{
+			`CREATE TABLE revoked_tokens (
+				jti VARCHAR(64) PRIMARY KEY,
+				expires_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX idx_revoked_tokens_expires_at ON revoked_tokens(expires_at)`,
+		},
+	},
+	{
+		version: 10,
+		name:    "add user roles",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user'`,
+		},
+	},
+	{
+		version: 11,
+		name:    "make emails case-insensitive",
+		statements: []string{
+			// Fails if existing accounts differ only by case; those must be merged by hand
+			`UPDATE users SET email = lower(trim(email)) WHERE email <> lower(trim(email))`,
+			`CREATE UNIQUE INDEX idx_users_email_lower ON users (lower(email))`,
+		},
+	},
+	{
+		version: 12,
+		name:    "add two-factor authentication",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64)`,
+			`ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version: 13,
+		name:    "add message feedback",
+		statements: []string{
+			`CREATE TABLE message_feedback (
+				message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				rating VARCHAR(10) NOT NULL CHECK (rating IN ('up', 'down')),
+				comment TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (message_id, user_id)
+			)`,
+		},
+	},
+	{
+		version: 14,
+		name:    "add conversation archiving",
+		statements: []string{
+			`ALTER TABLE conversations ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version: 15,
+		name:    "add conversation pinning",
+		statements: []string{
+			`ALTER TABLE conversations ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version: 16,
+		name:    "record why each reply stopped",
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN stop_reason VARCHAR(50)`,
+		},
+	},
+	{
+		version: 17,
+		name:    "add message attachments",
+		statements: []string{
+			`CREATE TABLE message_attachments (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				media_type VARCHAR(50) NOT NULL,
+				size INTEGER NOT NULL,
+				data BYTEA NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX idx_message_attachments_message_id ON message_attachments(message_id)`,
+		},
+	},
+	{
+		version: 18,
+		name:    "add idempotency keys",
+		statements: []string{
+			`CREATE TABLE idempotency_keys (
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				key VARCHAR(255) NOT NULL,
+				conversation_id UUID REFERENCES conversations(id) ON DELETE SET NULL,
+				response TEXT,
+				stop_reason VARCHAR(50),
+				completed_at TIMESTAMP,
+				expires_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (user_id, key)
+			)`,
+		},
+	},
+	{
+		version: 19,
+		name:    "add conversation tags",
+		statements: []string{
+			`CREATE TABLE tags (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name VARCHAR(50) NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (user_id, name)
+			)`,
+			`CREATE TABLE conversation_tags (
+				conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+				tag_id UUID NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+				PRIMARY KEY (conversation_id, tag_id)
+			)`,
+			`CREATE INDEX idx_conversation_tags_tag_id ON conversation_tags(tag_id)`,
+		},
+	},
+	{
+		version: 20,
+		name:    "add user settings",
+		statements: []string{
+			`CREATE TABLE user_settings (
+				user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+				model VARCHAR(100),
+				temperature DOUBLE PRECISION,
+				system_prompt TEXT,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+		},
+	},
+	{
+		// Replaced messages are kept for auditing. They are still removed
+		// along with their conversation.
+		version: 21,
+		name:    "add message soft deletion",
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN deleted_at TIMESTAMP`,
+		},
+	},
+	{
+		version: 22,
+		name:    "add per-user token revocation",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN tokens_valid_after TIMESTAMP`,
+		},
+	},
+	{
+		version: 23,
+		name:    "record usage per model",
+		statements: []string{
+			// Usage recorded before this has no model
+			`ALTER TABLE user_usage ADD COLUMN model VARCHAR(100) NOT NULL DEFAULT ''`,
+			`ALTER TABLE user_usage DROP CONSTRAINT user_usage_pkey`,
+			`ALTER TABLE user_usage ADD PRIMARY KEY (user_id, month, model)`,
+		},
+	},
+}
+
+// migrationLockID is the Postgres advisory lock key held while migrations run
+const migrationLockID = 7246531
+
+// RunMigrations applies any migrations not yet recorded in schema_migrations,
+// each in its own transaction. It holds an advisory lock for the duration so
+// that concurrently starting instances apply the migrations one at a time,
+// waiting up to lockTimeout for the lock (0 waits indefinitely).
+func RunMigrations(db *sql.DB, lockTimeout time.Duration) error {
+	// Advisory locks are per session, so everything runs on a single connection
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lockCtx := context.Background()
+	if lockTimeout > 0 {
+		var cancel context.CancelFunc
+		lockCtx, cancel = context.WithTimeout(lockCtx, lockTimeout)
+		defer cancel()
+	}
+
+	if _, err := conn.ExecContext(lockCtx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	ctx := context.Background()
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	applied := make(map[int]bool)
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs a migration and records it in a single transaction
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+		m.version, m.name,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
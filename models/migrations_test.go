@@ -0,0 +1,136 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diyorend/dashGPT-backend/dbtest"
+	"github.com/diyorend/dashGPT-backend/models"
+)
+
+type appliedMigration struct {
+	version   int
+	appliedAt time.Time
+}
+
+// appliedMigrations returns the migrations recorded in schema_migrations
+func appliedMigrations(t *testing.T, db *sql.DB) []appliedMigration {
+	t.Helper()
+
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		t.Fatalf("listing applied migrations: %v", err)
+	}
+	defer rows.Close()
+
+	var applied []appliedMigration
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.version, &m.appliedAt); err != nil {
+			t.Fatalf("listing applied migrations: %v", err)
+		}
+		applied = append(applied, m)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("listing applied migrations: %v", err)
+	}
+	return applied
+}
+
+// checkAllApplied fails the test unless every migration was applied exactly once
+func checkAllApplied(t *testing.T, applied []appliedMigration) {
+	t.Helper()
+
+	if len(applied) != models.MigrationCount {
+		t.Fatalf("%d migrations applied, want %d", len(applied), models.MigrationCount)
+	}
+	for i, m := range applied {
+		if m.version != i+1 {
+			t.Fatalf("applied migration %d is version %d, want %d", i, m.version, i+1)
+		}
+	}
+}
+
+func TestRunMigrationsTwiceIsANoOp(t *testing.T) {
+	db := dbtest.OpenSchema(t)
+
+	if err := models.RunMigrations(db, 0); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	first := appliedMigrations(t, db)
+	checkAllApplied(t, first)
+
+	if err := models.RunMigrations(db, 0); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if second := appliedMigrations(t, db); !reflect.DeepEqual(second, first) {
+		t.Errorf("second run changed applied migrations:\n got %v\nwant %v", second, first)
+	}
+}
+
+func TestRunMigrationsConcurrently(t *testing.T) {
+	db := dbtest.OpenSchema(t)
+
+	// Without the lock, instances would apply the same migrations at once and
+	// all but one would fail on the non-idempotent ones
+	const instances = 4
+	errs := make([]error, instances)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = models.RunMigrations(db, 0)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("instance %d: %v", i, err)
+		}
+	}
+	checkAllApplied(t, appliedMigrations(t, db))
+}
+
+func TestRunMigrationsWaitsForTheLock(t *testing.T) {
+	db := dbtest.OpenSchema(t)
+
+	// Hold the lock as another instance migrating would
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, models.MigrationLockID); err != nil {
+		t.Fatalf("acquiring migration lock: %v", err)
+	}
+
+	if err := models.RunMigrations(db, 100*time.Millisecond); err == nil {
+		t.Fatal("migrations ran while another instance held the lock")
+	}
+	var exists bool
+	err = db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM information_schema.tables
+		 WHERE table_schema = current_schema() AND table_name = 'schema_migrations')`,
+	).Scan(&exists)
+	if err != nil {
+		t.Fatalf("checking for schema_migrations: %v", err)
+	}
+	if exists {
+		t.Error("schema_migrations was created without the lock")
+	}
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, models.MigrationLockID); err != nil {
+		t.Fatalf("releasing migration lock: %v", err)
+	}
+	if err := models.RunMigrations(db, time.Second); err != nil {
+		t.Fatalf("after the lock was released: %v", err)
+	}
+	checkAllApplied(t, appliedMigrations(t, db))
+}
@@ -1,7 +1,6 @@
 package models
 
 import (
-	"database/sql"
 	"time"
 )
 
@@ -10,24 +9,63 @@ type User struct {
 	Email     string    `json:"email"`
 	Name      string    `json:"name"`
 	Password  string    `json:"-"`
+	Role      string    `json:"role"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type Conversation struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id"`
+	Title        string    `json:"title"`
+	MaxTokens    *int      `json:"max_tokens,omitempty"`
+	Temperature  *float64  `json:"temperature,omitempty"`
+	SystemPrompt *string   `json:"system_prompt,omitempty"`
+	Archived     bool      `json:"archived"`
+	Pinned       bool      `json:"pinned"`
+	Tags         []Tag     `json:"tags,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Tag is a user-defined label for organizing conversations into folders
+type Tag struct {
 	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Title     string    `json:"title"`
+	Name      string    `json:"name"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type Message struct {
-	ID             string    `json:"id"`
-	ConversationID string    `json:"conversation_id"`
-	Role           string    `json:"role"` // "user" or "assistant"
-	Content        string    `json:"content"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID             string       `json:"id"`
+	ConversationID string       `json:"conversation_id"`
+	Role           string       `json:"role"` // "user" or "assistant"
+	Content        string       `json:"content"`
+	Model          string       `json:"model,omitempty"`       // assistant messages only
+	StopReason     string       `json:"stop_reason,omitempty"` // assistant messages only, e.g. "max_tokens" if cut off
+	IsPinned       bool         `json:"is_pinned"`
+	Attachments    []Attachment `json:"attachments,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+	// DeletedAt is set on messages replaced by an edit or regeneration, which
+	// are only shown to admins
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Attachment is an image sent with a user message. Its data is only loaded to
+// build requests to the model and is fetched by clients separately.
+type Attachment struct {
+	ID        string `json:"id"`
+	MediaType string `json:"media_type"`
+	Size      int    `json:"size"`
+	Data      []byte `json:"-"`
+}
+
+type MessageFeedback struct {
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	Rating    string    `json:"rating"` // "up" or "down"
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type DashboardMetrics struct {
@@ -35,6 +73,7 @@ type DashboardMetrics struct {
 	Revenue     float64 `json:"revenue"`
 	Growth      float64 `json:"growth"`
 	ActiveUsers int     `json:"activeUsers"`
+	HasData     bool    `json:"hasData"`
 }
 
 type ChartDataPoint struct {
@@ -46,43 +85,5 @@ type ChartData struct {
 	Revenue    []ChartDataPoint `json:"revenue"`
 	Users      []ChartDataPoint `json:"users"`
 	Engagement []ChartDataPoint `json:"engagement"`
-}
-
-// RunMigrations creates all necessary database tables
-func RunMigrations(db *sql.DB) error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			email VARCHAR(255) UNIQUE NOT NULL,
-			name VARCHAR(255) NOT NULL,
-			password VARCHAR(255) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS conversations (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			title VARCHAR(500) DEFAULT 'New Conversation',
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS messages (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
-			role VARCHAR(50) NOT NULL,
-			content TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE INDEX IF NOT EXISTS idx_conversations_user_id ON conversations(user_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id)`,
-	}
-
-	for _, query := range queries {
-		_, err := db.Exec(query)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	HasData    bool             `json:"hasData"`
 }
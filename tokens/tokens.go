@@ -0,0 +1,197 @@
+// Package tokens signs and verifies JWTs, either with a shared HMAC secret or
+// with rotating RSA keys whose public halves are published as a JWKS
+package tokens
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeySet holds the keys used to sign and verify tokens
+type KeySet struct {
+	method     jwt.SigningMethod
+	secret     []byte
+	activeKID  string
+	privateKey *rsa.PrivateKey
+	publicKeys map[string]*rsa.PublicKey
+}
+
+// NewHMACKeySet signs and verifies tokens with HS256 and a shared secret
+func NewHMACKeySet(secret string) *KeySet {
+	return &KeySet{
+		method: jwt.SigningMethodHS256,
+		secret: []byte(secret),
+	}
+}
+
+// LoadRSAKeySet loads PEM-encoded RSA keys from dir, using each file's name
+// without its extension as the key ID. Tokens are signed with the active key,
+// which must be a private key, and verified with any key in the set, so a
+// retired key can be kept as a public key until its tokens have expired.
+func LoadRSAKeySet(dir, activeKID string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	k := &KeySet{
+		method:     jwt.SigningMethodRS256,
+		activeKID:  activeKID,
+		publicKeys: make(map[string]*rsa.PublicKey),
+	}
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		private, public, err := parseRSAKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", kid, err)
+		}
+
+		k.publicKeys[kid] = public
+		if kid == activeKID {
+			if private == nil {
+				return nil, fmt.Errorf("active key %s must be a private key", kid)
+			}
+			k.privateKey = private
+		}
+	}
+
+	if k.privateKey == nil {
+		return nil, fmt.Errorf("active key %s not found in %s", activeKID, dir)
+	}
+	return k, nil
+}
+
+// parseRSAKey decodes a PEM private or public RSA key. private is nil for
+// public keys.
+func parseRSAKey(data []byte) (private *rsa.PrivateKey, public *rsa.PublicKey, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return private, &private.PublicKey, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		private, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("not an RSA key")
+		}
+		return private, &private.PublicKey, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, nil, errors.New("not an RSA key")
+		}
+		return nil, public, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// Sign returns a signed token for the claims. RSA tokens carry the signing
+// key's ID in the kid header.
+func (k *KeySet) Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(k.method, claims)
+	if k.privateKey != nil {
+		token.Header["kid"] = k.activeKID
+		return token.SignedString(k.privateKey)
+	}
+	return token.SignedString(k.secret)
+}
+
+// Parse verifies a token's signature and expiry and returns its claims
+func (k *KeySet) Parse(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if k.privateKey == nil {
+			return k.secret, nil
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		public, ok := k.publicKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+		return public, nil
+	}, jwt.WithValidMethods([]string{k.method.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ServeJWKS publishes the public keys so other services can verify tokens.
+// The set is empty when tokens are signed with a shared secret.
+func (k *KeySet) ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	kids := make([]string, 0, len(k.publicKeys))
+	for kid := range k.publicKeys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	keys := []jwk{}
+	for _, kid := range kids {
+		public := k.publicKeys[kid]
+		keys = append(keys, jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": keys,
+	})
+}